@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// layoutEntry is one line of tree output read back in.
+type layoutEntry struct {
+	depth int
+	name  string
+	isDir bool
+	size  int64
+	link  string
+}
+
+var (
+	sizeAnnotation = regexp.MustCompile(` \((empty|\d+b|\d+(?:\.\d+)?[KMGTPE]iB)(?:, [\w.+-]+/[\w.+-]+)?\)$`)
+	// the bracketed notes the renderer can put after the size: cycles,
+	// --skip-large, --hash, --grep-count and --git
+	noteAnnotation = regexp.MustCompile(` \[(recursive, not followed|more than [\d,]+ entr(?:y|ies), not read|(?:sha256|md5|crc32):[0-9a-f]+|[\d,]+ hits?|(?:staged|unmerged|untracked|ignored|modified)(?:, modified)?)\]$`)
+	anyNote        = regexp.MustCompile(` \[[^\[\]]*\]$`)
+	moreEntries    = regexp.MustCompile(`^… [\d,]+ more entr(?:y|ies)$`)
+)
+
+// parseLayout reads the text format dirTree writes. Entries with a size
+// annotation are files, the ones without are directories, exactly like
+// the renderer tells them apart. Notes the renderer adds are dropped, a
+// line with a note it does not know, such as a read error, is rejected.
+// Reading stops at the first blank line, which is where the report starts.
+func parseLayout(r io.Reader) ([]layoutEntry, error) {
+	var entries []layoutEntry
+	// names[d-1] holds the names seen at depth d in the current directory
+	names := []map[string]bool{{}}
+	sc := bufio.NewScanner(r)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if line == "" {
+			if len(entries) > 0 {
+				break
+			}
+			continue
+		}
+
+		e := layoutEntry{depth: 1}
+		for {
+			if strings.HasPrefix(line, "│\t") {
+				line = line[len("│\t"):]
+			} else if strings.HasPrefix(line, "\t") {
+				line = line[1:]
+			} else {
+				break
+			}
+			e.depth++
+		}
+		if !strings.HasPrefix(line, "├───") && !strings.HasPrefix(line, "└───") {
+			return nil, fmt.Errorf("line %d: not a tree entry", lineNo)
+		}
+		line = line[len("├───"):]
+		if moreEntries.MatchString(line) {
+			// what --filelimit left out is not known
+			continue
+		}
+		for {
+			m := noteAnnotation.FindString(line)
+			if m == "" {
+				break
+			}
+			line = line[:len(line)-len(m)]
+		}
+		if m := anyNote.FindString(line); m != "" {
+			// most likely an error, which is no name to create things with
+			return nil, fmt.Errorf("line %d: unexpected annotation %q", lineNo, m[1:])
+		}
+
+		e.isDir = true
+		if m := sizeAnnotation.FindStringSubmatch(line); m != nil {
+			e.isDir = false
+			e.size = parseSize(m[1])
+			line = line[:len(line)-len(m[0])]
+		}
+		if i := strings.Index(line, " -> "); i >= 0 {
+			e.link = line[i+len(" -> "):]
+			line = line[:i]
+			e.isDir = false
+		}
+		e.name = line
+
+		if e.name == "" || e.name == "." || e.name == ".." || strings.ContainsAny(e.name, `/\`) {
+			return nil, fmt.Errorf("line %d: bad name %q", lineNo, e.name)
+		}
+		prev := 0
+		if len(entries) > 0 {
+			prev = entries[len(entries)-1].depth
+		}
+		if e.depth > prev+1 {
+			return nil, fmt.Errorf("line %d: %s is nested too deep", lineNo, e.name)
+		}
+		if e.depth == prev+1 && prev > 0 && !entries[len(entries)-1].isDir {
+			return nil, fmt.Errorf("line %d: %s is inside a file", lineNo, e.name)
+		}
+		names = names[:e.depth]
+		if names[e.depth-1][e.name] {
+			return nil, fmt.Errorf("line %d: %s is listed twice", lineNo, e.name)
+		}
+		names[e.depth-1][e.name] = true
+		names = append(names, map[string]bool{})
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+func parseSize(s string) int64 {
+	if s == "empty" {
+		return 0
+	}
+	if strings.HasSuffix(s, "b") {
+		n, _ := strconv.ParseInt(strings.TrimSuffix(s, "b"), 10, 64)
+		return n
+	}
+	// human readable sizes are rounded, so the result is only close
+	unit := strings.IndexByte("KMGTPE", s[len(s)-3]) + 1
+	f, _ := strconv.ParseFloat(s[:len(s)-3], 64)
+	for ; unit > 0; unit-- {
+		f *= 1024
+	}
+	return int64(f)
+}
+
+// applyLayout creates the entries read from r below dir. Files are made
+// sparse with the annotated size so the result lists the same way, and
+// existing files are never overwritten. Layouts come from anywhere, so
+// nothing is ever created through a symbolic link: a directory entry must
+// not already exist as anything but a real directory.
+func applyLayout(r io.Reader, dir string) error {
+	entries, err := parseLayout(r)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	parents := []string{dir}
+	for _, e := range entries {
+		parents = parents[:e.depth]
+		p := filepath.Join(parents[e.depth-1], e.name)
+
+		switch {
+		case e.isDir:
+			if fi, err := os.Lstat(p); err == nil && !fi.IsDir() {
+				return fmt.Errorf("%s: exists and is not a directory", p)
+			}
+			if err := os.MkdirAll(p, 0o755); err != nil {
+				return err
+			}
+			parents = append(parents, p)
+		case e.link != "":
+			if err := os.Symlink(e.link, p); err != nil {
+				return err
+			}
+		default:
+			if err := createPlaceholder(p, e.size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyLayoutFile reads the layout from name, "-" stands for stdin.
+func applyLayoutFile(name, dir string) error {
+	if name == "-" {
+		return applyLayout(os.Stdin, dir)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return applyLayout(f, dir)
+}
+
+func createPlaceholder(name string, size int64) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usageLine = "usage: tree [flags] [path ...]\n" +
+	"       tree --diff [flags] A B\n" +
+	"       tree --watch [--interval 1s] [flags] DIR\n" +
+	"       tree --apply LAYOUT DIR\n" +
+	"       tree --manifest FILE | --verify FILE [flags] DIR\n"
+
+const exitCodes = `
+exit status is 0 on success, 1 when some entries could not be read or
+--verify found drift, and 2 for bad usage or when nothing could be listed.
+`
+
+// cliArgs is the parsed command line: the options for the tree itself
+// plus the mode and its arguments.
+type cliArgs struct {
+	opts        options
+	roots       []string
+	diff        bool
+	watch       bool
+	interval    time.Duration
+	apply       string
+	manifestOut string
+	manifestIn  string
+	color       bool
+}
+
+// newFlagSet declares every flag of the tree command. This is the one place
+// to add new ones.
+func newFlagSet(c *cliArgs) *flag.FlagSet {
+	fs := flag.NewFlagSet("tree", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	o := &c.opts
+
+	fs.BoolVar(&o.All, "a", false, "list hidden files and directories too")
+	fs.BoolVar(&o.PrintFiles, "f", false, "list files, not only directories")
+	fs.StringVar(&o.Format, "o", o.Format, "output `format`: text, json, xml, yaml, html or md")
+	fs.Var((*positiveInt)(&o.MaxDepth), "L", "descend at most `level` directories")
+	fs.BoolVar(&o.Prune, "prune", false, "leave out directories without files")
+	fs.Var((*patternList)(&o.Include), "P", "list only files matching `pattern`, alternatives separated by |")
+	fs.Var((*patternList)(&o.Exclude), "I", "leave out entries matching `pattern`, alternatives separated by |")
+	fs.BoolVar(&o.GitIgnore, "gitignore", false, "leave out entries ignored by .gitignore files")
+	fs.BoolVar(&o.DirSizes, "du", false, "show the accumulated size of directories")
+	fs.BoolVar(&o.Human, "h", false, "print sizes in human readable units")
+	fs.BoolVar(&o.Strict, "strict", false, "report unreadable entries on stderr")
+	fs.BoolVar(&o.FollowLinks, "l", false, "follow symbolic links to directories")
+	fs.Var((*positiveInt)(&o.Jobs), "j", "read up to `jobs` directories in parallel")
+	fs.BoolVar(&o.Checksum, "checksum", false, "with --diff, compare file contents and not only sizes")
+	fs.StringVar(&o.Sort, "sort", "", "sort by `key`: name, size, mtime or ext")
+	fs.BoolVar(&o.Reverse, "reverse", false, "reverse the sort order")
+	fs.BoolVar(&o.DirsFirst, "dirs-first", false, "list directories before files")
+	fs.BoolVar(&o.Perms, "p", false, "print permissions")
+	fs.BoolVar(&o.Owner, "u", false, "print the owner")
+	fs.BoolVar(&o.Group, "g", false, "print the group")
+	fs.BoolVar(&o.Dates, "D", false, "print the modification time")
+	fs.StringVar(&o.Hash, "hash", "", "list files with their checksums, `algo` is sha256, md5 or crc32")
+	fs.BoolVar(&o.Dupes, "dupes", false, "list files with the same contents")
+	fs.Var(negatedBool{&o.Report}, "noreport", "leave out the directory and file count")
+	fs.BoolVar(&o.Stats, "stats", false, "print size statistics per file extension")
+	fs.Var(colorFlag{&c.color, true}, "C", "always colorize names")
+	fs.Var(colorFlag{&c.color, false}, "n", "never colorize names")
+	fs.Var((*positiveInt)(&o.FileLimit), "filelimit", "list at most `n` entries per directory")
+	fs.Var((*positiveInt)(&o.SkipLarge), "skip-large", "stop reading directories with more than `n` entries")
+	fs.StringVar(&o.Grep, "grep", "", "list only files with lines matching the regular expression `pattern`")
+	fs.BoolVar(&o.GrepCount, "grep-count", false, "with --grep, print the number of matching lines")
+	fs.BoolVar(&o.ShowType, "type", false, "print the content type of files")
+	fs.Var((*kindList)(&o.Only), "only", "list only files of the `kinds`, separated by commas: archives, audio, documents, fonts, images, text or video")
+	fs.BoolVar(&o.GitStatus, "git", false, "mark files as staged, modified, untracked or ignored in their git repository")
+	fs.BoolVar(&o.Stream, "U", false, "print entries unsorted while reading, for huge directories")
+
+	fs.BoolVar(&c.diff, "diff", false, "show the differences between two trees")
+	fs.BoolVar(&c.watch, "watch", false, "redraw the tree whenever it changes")
+	fs.DurationVar(&c.interval, "interval", c.interval, "how often --watch looks for changes")
+	fs.StringVar(&c.apply, "apply", "", "create the directories and files listed in `layout`, - for stdin")
+	fs.StringVar(&c.manifestOut, "manifest", "", "write a manifest of the tree to `file`")
+	fs.StringVar(&c.manifestIn, "verify", "", "compare the tree with the manifest in `file`")
+	return fs
+}
+
+// parseArgs reads flags and paths in any order, everything after "--" is
+// a path. It returns flag.ErrHelp for -help and --help.
+func parseArgs(args []string, defaults options, color bool) (*cliArgs, error) {
+	c := &cliArgs{opts: defaults, interval: time.Second, color: color}
+	fs := newFlagSet(c)
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			break
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			c.roots = append(c.roots, rest...)
+			break
+		}
+		c.roots = append(c.roots, rest[0])
+		args = rest[1:]
+	}
+	if c.interval <= 0 {
+		return nil, errors.New("--interval must be positive")
+	}
+
+	var modes []string
+	for _, m := range []struct {
+		name string
+		set  bool
+	}{
+		{"--diff", c.diff},
+		{"--watch", c.watch},
+		{"--apply", c.apply != ""},
+		{"--manifest", c.manifestOut != ""},
+		{"--verify", c.manifestIn != ""},
+	} {
+		if m.set {
+			modes = append(modes, m.name)
+		}
+	}
+	switch {
+	case len(modes) > 1:
+		return nil, fmt.Errorf("%s cannot be combined", strings.Join(modes, " and "))
+	case len(modes) == 1 && c.opts.Stream:
+		return nil, fmt.Errorf("-U cannot be combined with %s", modes[0])
+	case c.diff:
+		if len(c.roots) != 2 {
+			return nil, errors.New("--diff needs exactly two paths")
+		}
+	case len(modes) == 1:
+		if len(c.roots) != 1 {
+			return nil, fmt.Errorf("%s needs exactly one path", modes[0])
+		}
+	case len(c.roots) > 1 && !c.opts.textOutput():
+		// the other formats are a single document with one root
+		return nil, fmt.Errorf("-o %s needs exactly one path", c.opts.Format)
+	case len(c.roots) == 0:
+		c.roots = []string{"."}
+	}
+	return c, nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, usageLine, "\nflags:\n")
+	fs := newFlagSet(&cliArgs{opts: options{Format: "text"}, interval: time.Second})
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+	fmt.Fprint(w, exitCodes)
+}
+
+type positiveInt int
+
+func (p *positiveInt) String() string {
+	if p == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*p))
+}
+
+func (p *positiveInt) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return errors.New("must be a positive number")
+	}
+	*p = positiveInt(n)
+	return nil
+}
+
+// patternList collects the patterns of a flag that may be repeated.
+type patternList []string
+
+func (l *patternList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, "|")
+}
+
+func (l *patternList) Set(s string) error {
+	*l = append(*l, strings.Split(s, "|")...)
+	return nil
+}
+
+// kindList collects the file kinds of --only.
+type kindList []string
+
+func (l *kindList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *kindList) Set(s string) error {
+	*l = append(*l, strings.Split(s, ",")...)
+	return nil
+}
+
+// negatedBool is a boolean flag that turns an option off.
+type negatedBool struct {
+	p *bool
+}
+
+func (b negatedBool) String() string {
+	return "false"
+}
+
+func (b negatedBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*b.p = !v
+	return nil
+}
+
+func (b negatedBool) IsBoolFlag() bool {
+	return true
+}
+
+// colorFlag is one of the -C and -n pair, the last one given wins.
+type colorFlag struct {
+	p  *bool
+	on bool
+}
+
+func (c colorFlag) String() string {
+	return "false"
+}
+
+func (c colorFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if v {
+		*c.p = c.on
+	}
+	return nil
+}
+
+func (c colorFlag) IsBoolFlag() bool {
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// defaultLSColors is used when LS_COLORS is not set, it mirrors the
+// dircolors defaults for the entry types tree knows about.
+const defaultLSColors = "rs=0:di=01;34:ln=01;36:so=01;35:pi=40;33:bd=40;33;01:cd=40;33;01:or=40;31;01:ex=01;32"
+
+var statusColors = map[string]string{
+	statusAdded:   "32",
+	statusRemoved: "31",
+	statusChanged: "33",
+}
+
+// lsColors is a parsed LS_COLORS value: two letter type keys such as "di"
+// or "ex" and "*.ext" suffix patterns, each mapped to an SGR sequence.
+type lsColors struct {
+	types    map[string]string
+	suffixes map[string]string
+}
+
+func parseLSColors(s string) *lsColors {
+	if s == "" {
+		s = defaultLSColors
+	}
+	c := &lsColors{types: map[string]string{}, suffixes: map[string]string{}}
+	for _, item := range strings.Split(s, ":") {
+		eq := strings.IndexByte(item, '=')
+		if eq <= 0 {
+			continue
+		}
+		key, code := item[:eq], item[eq+1:]
+		if strings.HasPrefix(key, "*") {
+			c.suffixes[strings.ToLower(key[1:])] = code
+		} else {
+			c.types[key] = code
+		}
+	}
+	return c
+}
+
+func (c *lsColors) paint(n *node, s string) string {
+	code := c.code(n)
+	if code == "" || code == "0" {
+		return s
+	}
+	reset := c.types["rs"]
+	if reset == "" {
+		reset = "0"
+	}
+	return "\x1b[" + code + "m" + s + "\x1b[" + reset + "m"
+}
+
+// paintStatus highlights the diff and watch markers.
+func (c *lsColors) paintStatus(status string) string {
+	if status == "" {
+		return ""
+	}
+	return "\x1b[" + statusColors[status] + "m" + statusMarks[status] + "\x1b[0m"
+}
+
+func (c *lsColors) code(n *node) string {
+	switch {
+	case n.Link != "" && n.orphan:
+		if code, ok := c.types["or"]; ok {
+			return code
+		}
+		return c.types["ln"]
+	case n.Link != "":
+		return c.types["ln"]
+	case n.isDir():
+		return c.types["di"]
+	}
+
+	switch t := n.mode.Type(); {
+	case t&fs.ModeNamedPipe != 0:
+		return c.types["pi"]
+	case t&fs.ModeSocket != 0:
+		return c.types["so"]
+	case t&fs.ModeCharDevice != 0:
+		return c.types["cd"]
+	case t&fs.ModeDevice != 0:
+		return c.types["bd"]
+	}
+	if n.mode&0o111 != 0 {
+		if code, ok := c.types["ex"]; ok {
+			return code
+		}
+	}
+	if code := c.suffixCode(n.Name); code != "" {
+		return code
+	}
+	return c.types["fi"]
+}
+
+// suffixCode finds the longest "*suffix" pattern the name ends with, so
+// "*.tar.gz" wins over "*.gz" like in ls.
+func (c *lsColors) suffixCode(name string) string {
+	name = strings.ToLower(name)
+	code, best := "", 0
+	for suffix, sc := range c.suffixes {
+		if len(suffix) > best && strings.HasSuffix(name, suffix) {
+			code, best = sc, len(suffix)
+		}
+	}
+	return code
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&fs.ModeCharDevice != 0
+}
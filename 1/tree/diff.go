@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+const (
+	statusAdded   = "added"
+	statusRemoved = "removed"
+	statusChanged = "changed"
+)
+
+var statusMarks = map[string]string{
+	statusAdded:   "[+] ",
+	statusRemoved: "[-] ",
+	statusChanged: "[~] ",
+}
+
+type diffStats struct {
+	added, removed, changed int
+}
+
+func (s diffStats) String() string {
+	return fmt.Sprintf("%d added, %d removed, %d changed", s.added, s.removed, s.changed)
+}
+
+// differ merges two trees into one, marking every entry that only exists on
+// one side or differs between them. Files of the same size are only read
+// and compared by hash with --checksum, watch mode goes by mtime instead.
+type differ struct {
+	oldFS, newFS fs.FS
+	opts         options
+	mtimes       bool
+	stats        diffStats
+	errs         []error
+}
+
+// diffTree renders the merged tree of the directories (or archives) a and b
+// followed by a summary line.
+func diffTree(out io.Writer, a, b string, opts options) (walkErr, err error) {
+	render, err := lookupRenderer(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOptions(opts); err != nil {
+		return nil, err
+	}
+	opts.PrintFiles = true
+
+	d := &differ{opts: opts}
+	var roots [2]*node
+	for i, p := range []string{a, b} {
+		fsys, closer, err := openSource(p, opts.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		if closer != nil {
+			defer closer.Close()
+		}
+		root, err := buildTree(fsys, ".", opts)
+		if root == nil {
+			return nil, err
+		}
+		if err != nil {
+			d.errs = append(d.errs, err)
+		}
+		roots[i] = root
+		if i == 0 {
+			d.oldFS = fsys
+		} else {
+			d.newFS = fsys
+		}
+	}
+
+	merged := &node{Name: roots[1].Name, Type: typeDir}
+	merged.Children = d.merge(".", roots[0].Children, roots[1].Children)
+	if err := render(out, merged, opts); err != nil {
+		return nil, err
+	}
+	if opts.textOutput() {
+		if _, err := fmt.Fprintf(out, "\n%s\n", d.stats); err != nil {
+			return nil, err
+		}
+	}
+	if len(d.errs) > 0 {
+		return walkErrors(d.errs), nil
+	}
+	return nil, nil
+}
+
+func (d *differ) merge(dir string, old, cur []*node) []*node {
+	byName := make(map[string]*node, len(old))
+	for _, n := range old {
+		byName[n.Name] = n
+	}
+
+	var merged []*node
+	for _, n := range cur {
+		o, ok := byName[n.Name]
+		if !ok {
+			merged = append(merged, d.mark(n, statusAdded))
+			continue
+		}
+		delete(byName, n.Name)
+
+		if o.Type != n.Type {
+			merged = append(merged, d.mark(o, statusRemoved), d.mark(n, statusAdded))
+			continue
+		}
+		m := *n
+		if n.isDir() {
+			m.Children = d.merge(path.Join(dir, n.Name), o.Children, n.Children)
+		} else if d.fileChanged(path.Join(dir, n.Name), o, n) {
+			m.Status = statusChanged
+			d.stats.changed++
+		}
+		merged = append(merged, &m)
+	}
+	for _, o := range byName {
+		merged = append(merged, d.mark(o, statusRemoved))
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Name < merged[j].Name
+	})
+	sortNodes(merged, d.opts)
+	return merged
+}
+
+// mark flags n and everything below it with status.
+func (d *differ) mark(n *node, status string) *node {
+	m := *n
+	m.Status = status
+	if status == statusAdded {
+		d.stats.added++
+	} else {
+		d.stats.removed++
+	}
+	m.Children = make([]*node, len(n.Children))
+	for i, c := range n.Children {
+		m.Children[i] = d.mark(c, status)
+	}
+	return &m
+}
+
+func (d *differ) fileChanged(name string, old, cur *node) bool {
+	if old.Size != cur.Size || old.Link != cur.Link {
+		return true
+	}
+	if d.mtimes && !old.ModTime.Equal(cur.ModTime) {
+		return true
+	}
+	if !d.opts.Checksum || cur.Type != typeFile {
+		return false
+	}
+	oldSum, err := fileDigest(d.oldFS, name, "sha256")
+	if err != nil {
+		d.errs = append(d.errs, err)
+		return false
+	}
+	curSum, err := fileDigest(d.newFS, name, "sha256")
+	if err != nil {
+		d.errs = append(d.errs, err)
+		return false
+	}
+	return oldSum != curSum
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// gitIndexEntry is what the index remembers about a staged file, enough to
+// tell whether the file on disk still has the staged contents.
+type gitIndexEntry struct {
+	mtimeSec  uint32
+	mtimeNsec uint32
+	mode      uint32
+	size      uint32
+	id        string
+	stage     int
+}
+
+// readGitIndex reads the entries of the index file name, versions 2 to 4.
+// Extensions such as the cached trees are not needed and skipped.
+func readGitIndex(name string) (map[string]gitIndexEntry, error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]gitIndexEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || string(data[:4]) != "DIRC" {
+		return nil, fmt.Errorf("%s: not an index file", name)
+	}
+	version := binary.BigEndian.Uint32(data[4:])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("%s: unsupported index version %d", name, version)
+	}
+	count := int(binary.BigEndian.Uint32(data[8:]))
+
+	entries := make(map[string]gitIndexEntry, count)
+	corrupt := fmt.Errorf("%s: corrupt index", name)
+	pos, prev := 12, ""
+	for i := 0; i < count; i++ {
+		start := pos
+		if len(data) < pos+62 {
+			return nil, corrupt
+		}
+		e := gitIndexEntry{
+			mtimeSec:  binary.BigEndian.Uint32(data[pos+8:]),
+			mtimeNsec: binary.BigEndian.Uint32(data[pos+12:]),
+			mode:      binary.BigEndian.Uint32(data[pos+24:]),
+			size:      binary.BigEndian.Uint32(data[pos+36:]),
+			id:        hex.EncodeToString(data[pos+40 : pos+60]),
+		}
+		flags := binary.BigEndian.Uint16(data[pos+60:])
+		e.stage = int(flags>>12) & 3
+		pos += 62
+		if flags&0x4000 != 0 {
+			pos += 2
+		}
+		if len(data) < pos {
+			return nil, corrupt
+		}
+
+		if version == 4 {
+			// the name only stores what differs from the previous one
+			strip, n := gitVarint(data[pos:])
+			if n == 0 || strip > len(prev) {
+				return nil, corrupt
+			}
+			pos += n
+			nul := bytes.IndexByte(data[pos:], 0)
+			if nul < 0 {
+				return nil, corrupt
+			}
+			prev = prev[:len(prev)-strip] + string(data[pos:pos+nul])
+			pos += nul + 1
+		} else {
+			nul := bytes.IndexByte(data[pos:], 0)
+			if nul < 0 {
+				return nil, corrupt
+			}
+			prev = string(data[pos : pos+nul])
+			// entries are padded with 1 to 8 NUL bytes to a multiple of 8
+			pos = start + (pos+nul-start+8)&^7
+		}
+		if old, ok := entries[prev]; !ok || old.stage == 0 && e.stage > 0 {
+			entries[prev] = e
+		}
+	}
+	return entries, nil
+}
+
+// gitVarint decodes the offset encoding git uses in packs and version 4
+// indexes, it returns the value and the number of bytes read.
+func gitVarint(b []byte) (int, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	v := int(b[0] & 0x7f)
+	n := 1
+	for b[n-1]&0x80 != 0 {
+		if n == len(b) {
+			return 0, 0
+		}
+		v = (v+1)<<7 | int(b[n]&0x7f)
+		n++
+	}
+	return v, n
+}
+
+// gitLabels spell out the two letter codes of git status --short.
+var gitLabels = map[byte]string{
+	'A': "staged",
+	'M': "staged",
+	'U': "unmerged",
+	'?': "untracked",
+	'!': "ignored",
+}
+
+// gitStatus works out the git status --short code of the files in a tree:
+// staged changes in the first column, unstaged ones in the second. Files
+// deleted on disk are not in the tree and so never marked.
+type gitStatus struct {
+	fsys    fs.FS
+	repo    *gitRepo
+	head    map[string]gitTreeEntry
+	index   map[string]gitIndexEntry
+	work    fs.FS
+	exclude *ignoreFile
+	stacks  map[string][]*ignoreFile
+	errs    []error
+}
+
+// markGitStatus is a no-op for trees that are not in a repository on disk.
+func markGitStatus(fsys fs.FS, root *node) []error {
+	dir := osPath(fsys, ".")
+	if dir == "" {
+		return nil
+	}
+	repo, err := findGitRepo(dir)
+	if repo == nil {
+		if err != nil {
+			return []error{err}
+		}
+		return nil
+	}
+	defer repo.Close()
+
+	s := &gitStatus{
+		fsys:   fsys,
+		repo:   repo,
+		head:   map[string]gitTreeEntry{},
+		work:   os.DirFS(repo.workTree),
+		stacks: map[string][]*ignoreFile{},
+	}
+	if tree, err := repo.headTree(); err != nil {
+		return []error{err}
+	} else if tree != "" {
+		if err := repo.readTree(tree, "", s.head); err != nil {
+			return []error{err}
+		}
+	}
+	if s.index, err = readGitIndex(filepath.Join(repo.gitDir, "index")); err != nil {
+		return []error{err}
+	}
+	if s.exclude, err = readIgnoreFile(os.DirFS(repo.commonDir), "info/exclude", ""); err != nil {
+		s.errs = append(s.errs, err)
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return []error{err}
+	}
+	prefix, err := filepath.Rel(repo.workTree, abs)
+	if err != nil {
+		return []error{err}
+	}
+	if prefix = filepath.ToSlash(prefix); prefix == "." {
+		prefix = ""
+	}
+	s.mark(root, ".", prefix, s.ignoredDir(prefix))
+	return s.errs
+}
+
+// ignoredDir reports whether the repository directory dir or one of its
+// parents is ignored, which makes everything below it ignored too.
+func (s *gitStatus) ignoredDir(dir string) bool {
+	if dir == "" {
+		return false
+	}
+	parent := path.Dir(dir)
+	if parent == "." {
+		parent = ""
+	}
+	return s.ignoredDir(parent) || ignored(s.ignores(parent), dir, true)
+}
+
+// mark sets the status of the entries below parent, dir is its path in
+// the tree and repoDir the one in the repository.
+func (s *gitStatus) mark(parent *node, dir, repoDir string, ignoredDir bool) {
+	for _, n := range parent.Children {
+		p, repoPath := path.Join(dir, n.Name), path.Join(repoDir, n.Name)
+		switch {
+		case n.Type == typeMore || n.Error != "" || n.Name == ".git":
+		case n.isDir() && n.Link == "":
+			if ie, ok := s.index[repoPath]; ok && ie.mode&0o170000 == 0o160000 {
+				// a submodule has a status of its own
+				continue
+			}
+			ign := ignoredDir || ignored(s.ignores(repoDir), repoPath, true)
+			if _, err := fs.Stat(s.fsys, path.Join(p, ".git")); err == nil {
+				// a nested repository shows up as a whole, like in git
+				n.Git = "??"
+				if ign {
+					n.Git = "!!"
+				}
+				continue
+			}
+			s.mark(n, p, repoPath, ign)
+		default:
+			n.Git = s.code(n, p, repoDir, repoPath, ignoredDir)
+		}
+	}
+}
+
+func (s *gitStatus) code(n *node, name, repoDir, repoPath string, ignoredDir bool) string {
+	ie, tracked := s.index[repoPath]
+	if !tracked {
+		if ignoredDir || ignored(s.ignores(repoDir), repoPath, false) {
+			return "!!"
+		}
+		return "??"
+	}
+	if ie.stage > 0 {
+		return "UU"
+	}
+
+	x, y := byte(' '), byte(' ')
+	if he, ok := s.head[repoPath]; !ok {
+		x = 'A'
+	} else if he.id != ie.id || he.mode != ie.mode {
+		x = 'M'
+	}
+	if s.changed(n, name, ie) {
+		y = 'M'
+	}
+	if x == ' ' && y == ' ' {
+		return ""
+	}
+	return string([]byte{x, y})
+}
+
+// changed compares the file on disk with its index entry. Like git it
+// trusts an unchanged size and mtime and only hashes the contents when
+// those differ.
+func (s *gitStatus) changed(n *node, name string, ie gitIndexEntry) bool {
+	isLink := ie.mode&0o170000 == 0o120000
+	if n.Link != "" {
+		if !isLink {
+			return true
+		}
+		id, _ := blobID(strings.NewReader(n.Link), int64(len(n.Link)))
+		return id != ie.id
+	}
+	if isLink || (n.mode&0o111 != 0) != (ie.mode&0o111 != 0) || uint32(n.Size) != ie.size {
+		return true
+	}
+	if uint32(n.ModTime.Unix()) == ie.mtimeSec && uint32(n.ModTime.Nanosecond()) == ie.mtimeNsec {
+		return false
+	}
+
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		s.errs = append(s.errs, err)
+		n.Error = err.Error()
+		return false
+	}
+	defer f.Close()
+	id, err := blobID(f, n.Size)
+	if err != nil {
+		s.errs = append(s.errs, err)
+		n.Error = err.Error()
+		return false
+	}
+	return id != ie.id
+}
+
+// ignores returns the ignore files that apply to the entries of the
+// repository directory dir, info/exclude and the .gitignore files from the
+// top of the work tree down.
+func (s *gitStatus) ignores(dir string) []*ignoreFile {
+	if stack, ok := s.stacks[dir]; ok {
+		return stack
+	}
+	var stack []*ignoreFile
+	if dir == "" {
+		if s.exclude != nil {
+			stack = append(stack, s.exclude)
+		}
+	} else {
+		parent := path.Dir(dir)
+		if parent == "." {
+			parent = ""
+		}
+		stack = s.ignores(parent)
+	}
+	ign, err := readIgnoreFile(s.work, path.Join(dir, ".gitignore"), dir)
+	if err != nil {
+		s.errs = append(s.errs, err)
+	}
+	if ign != nil {
+		stack = append(stack[:len(stack):len(stack)], ign)
+	}
+	s.stacks[dir] = stack
+	return stack
+}
+
+func getGitStr(n *node) string {
+	if n.Git == "" {
+		return ""
+	}
+	var labels []string
+	if n.Git[0] != ' ' {
+		labels = append(labels, gitLabels[n.Git[0]])
+	}
+	if n.Git[1] == 'M' {
+		labels = append(labels, "modified")
+	}
+	return " [" + strings.Join(labels, ", ") + "]"
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// gitRepo reads a repository the way git itself stores it: refs as files
+// or in packed-refs, objects loose or in packfiles. Only what --git needs
+// is there: SHA-1 repositories, and nothing is ever written.
+type gitRepo struct {
+	gitDir    string // HEAD and index, per worktree
+	commonDir string // objects and refs, shared between worktrees
+	workTree  string
+	packs     []*gitPack
+}
+
+type gitPack struct {
+	idx  []byte
+	pack *os.File
+}
+
+const (
+	objCommit   = 1
+	objTree     = 2
+	objBlob     = 3
+	objTag      = 4
+	objOfsDelta = 6
+	objRefDelta = 7
+)
+
+// findGitRepo looks for the repository dir is part of, going up from it
+// like git does. It returns nil without an error outside of repositories.
+func findGitRepo(dir string) (*gitRepo, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for d := abs; ; {
+		dotGit := filepath.Join(d, ".git")
+		fi, err := os.Stat(dotGit)
+		if err == nil {
+			gitDir := dotGit
+			if !fi.IsDir() {
+				// worktrees and submodules point to the real directory
+				if gitDir, err = readGitFile(dotGit); err != nil {
+					return nil, err
+				}
+			}
+			return openGitRepo(gitDir, d)
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return nil, nil
+		}
+		d = parent
+	}
+}
+
+func readGitFile(name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(line, "gitdir: ") {
+		return "", fmt.Errorf("%s: not a git file", name)
+	}
+	dir := strings.TrimPrefix(line, "gitdir: ")
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(name), dir)
+	}
+	return dir, nil
+}
+
+func openGitRepo(gitDir, workTree string) (*gitRepo, error) {
+	r := &gitRepo{gitDir: gitDir, commonDir: gitDir, workTree: workTree}
+	if data, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		common := strings.TrimSpace(string(data))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(gitDir, common)
+		}
+		r.commonDir = common
+	}
+	if config, err := os.ReadFile(filepath.Join(r.commonDir, "config")); err == nil {
+		for _, line := range strings.Split(string(config), "\n") {
+			if f := strings.Fields(strings.ToLower(line)); len(f) == 3 && f[0] == "objectformat" && f[2] != "sha1" {
+				return nil, fmt.Errorf("%s: object format %s is not supported", gitDir, f[2])
+			}
+		}
+	}
+
+	idxFiles, err := filepath.Glob(filepath.Join(r.commonDir, "objects", "pack", "*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range idxFiles {
+		p, err := openGitPack(name)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.packs = append(r.packs, p)
+	}
+	return r, nil
+}
+
+func (r *gitRepo) Close() error {
+	for _, p := range r.packs {
+		p.pack.Close()
+	}
+	return nil
+}
+
+// headTree returns the tree of the commit HEAD points to, or "" on a branch
+// without commits yet.
+func (r *gitRepo) headTree() (string, error) {
+	id, err := r.resolveRef("HEAD")
+	if err != nil || id == "" {
+		return "", err
+	}
+	typ, data, err := r.readObject(id)
+	if err != nil {
+		return "", err
+	}
+	if typ != objCommit || !bytes.HasPrefix(data, []byte("tree ")) {
+		return "", fmt.Errorf("HEAD: %s is not a commit", id)
+	}
+	line := data[len("tree "):]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return string(line), nil
+}
+
+func (r *gitRepo) resolveRef(name string) (string, error) {
+	for depth := 0; depth < 10; depth++ {
+		dir := r.commonDir
+		if !strings.HasPrefix(name, "refs/") {
+			dir = r.gitDir
+		}
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if errors.Is(err, os.ErrNotExist) {
+			return r.packedRef(name)
+		}
+		if err != nil {
+			return "", err
+		}
+		ref := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(ref, "ref: ") {
+			return ref, nil
+		}
+		name = strings.TrimPrefix(ref, "ref: ")
+	}
+	return "", fmt.Errorf("%s: too many levels of symbolic refs", name)
+}
+
+// packedRef looks name up in packed-refs, a branch that was never
+// committed to is in neither place.
+func (r *gitRepo) packedRef(name string) (string, error) {
+	f, err := os.Open(filepath.Join(r.commonDir, "packed-refs"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) == 2 && f[1] == name {
+			return f[0], nil
+		}
+	}
+	return "", sc.Err()
+}
+
+// gitTreeEntry is a blob or link of a tree, flattened to its full path.
+type gitTreeEntry struct {
+	mode uint32
+	id   string
+}
+
+// readTree lists every blob below the tree id with paths from the root.
+func (r *gitRepo) readTree(id, prefix string, entries map[string]gitTreeEntry) error {
+	typ, data, err := r.readObject(id)
+	if err != nil {
+		return err
+	}
+	if typ != objTree {
+		return fmt.Errorf("%s: not a tree", id)
+	}
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+21 {
+			return fmt.Errorf("%s: corrupt tree", id)
+		}
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return fmt.Errorf("%s: corrupt tree", id)
+		}
+		name := prefix + string(data[sp+1:nul])
+		child := hex.EncodeToString(data[nul+1 : nul+21])
+		data = data[nul+21:]
+
+		switch mode & 0o170000 {
+		case 0o040000:
+			if err := r.readTree(child, name+"/", entries); err != nil {
+				return err
+			}
+		case 0o160000:
+			// submodule commits live in another repository
+		default:
+			entries[name] = gitTreeEntry{mode: uint32(mode), id: child}
+		}
+	}
+	return nil
+}
+
+func (r *gitRepo) readObject(id string) (int, []byte, error) {
+	raw, err := hex.DecodeString(id)
+	if err != nil || len(raw) != sha1.Size {
+		return 0, nil, fmt.Errorf("bad object id %q", id)
+	}
+	f, err := os.Open(filepath.Join(r.commonDir, "objects", id[:2], id[2:]))
+	if err == nil {
+		defer f.Close()
+		return readLooseObject(f, id)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, nil, err
+	}
+	for _, p := range r.packs {
+		if off, ok := p.find(raw); ok {
+			return r.readPacked(p, off)
+		}
+	}
+	return 0, nil, fmt.Errorf("object %s not found", id)
+}
+
+var objTypes = map[string]int{"commit": objCommit, "tree": objTree, "blob": objBlob, "tag": objTag}
+
+func readLooseObject(f io.Reader, id string) (int, []byte, error) {
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return 0, nil, fmt.Errorf("object %s: %v", id, err)
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return 0, nil, fmt.Errorf("object %s: %v", id, err)
+	}
+	nul := bytes.IndexByte(data, 0)
+	sp := bytes.IndexByte(data, ' ')
+	if nul < 0 || sp < 0 || sp > nul {
+		return 0, nil, fmt.Errorf("object %s: bad header", id)
+	}
+	typ, ok := objTypes[string(data[:sp])]
+	if !ok {
+		return 0, nil, fmt.Errorf("object %s: unknown type %q", id, data[:sp])
+	}
+	return typ, data[nul+1:], nil
+}
+
+func openGitPack(idxName string) (*gitPack, error) {
+	idx, err := os.ReadFile(idxName)
+	if err != nil {
+		return nil, err
+	}
+	// version 2 is the only index format written since git 1.5.2
+	if len(idx) < 8+256*4 || !bytes.HasPrefix(idx, []byte("\xfftOc\x00\x00\x00\x02")) {
+		return nil, fmt.Errorf("%s: unsupported pack index", idxName)
+	}
+	n := int(binary.BigEndian.Uint32(idx[8+255*4:]))
+	if len(idx) < 8+256*4+n*(20+4+4) {
+		return nil, fmt.Errorf("%s: truncated pack index", idxName)
+	}
+	pack, err := os.Open(strings.TrimSuffix(idxName, ".idx") + ".pack")
+	if err != nil {
+		return nil, err
+	}
+	return &gitPack{idx: idx, pack: pack}, nil
+}
+
+// find returns the offset of the object id in the pack.
+func (p *gitPack) find(id []byte) (int64, bool) {
+	fanout := func(b int) int {
+		if b < 0 {
+			return 0
+		}
+		return int(binary.BigEndian.Uint32(p.idx[8+b*4:]))
+	}
+	n := fanout(255)
+	lo, hi := fanout(int(id[0])-1), fanout(int(id[0]))
+	ids := p.idx[8+256*4:]
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(ids[(lo+i)*20:(lo+i+1)*20], id) >= 0
+	})
+	if i == hi || !bytes.Equal(ids[i*20:(i+1)*20], id) {
+		return 0, false
+	}
+
+	offsets := ids[n*(20+4):]
+	off := binary.BigEndian.Uint32(offsets[i*4:])
+	if off&0x80000000 == 0 {
+		return int64(off), true
+	}
+	// offsets past 2GiB are kept in a separate table of 64 bit values
+	large := offsets[n*4:]
+	j := int(off & 0x7fffffff)
+	if len(large) < (j+1)*8 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(large[j*8:])), true
+}
+
+func (r *gitRepo) readPacked(p *gitPack, off int64) (int, []byte, error) {
+	br := bufio.NewReader(io.NewSectionReader(p.pack, off, 1<<62))
+	c, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	typ := int(c>>4) & 7
+	size := int64(c & 0x0f)
+	for shift := 4; c&0x80 != 0; shift += 7 {
+		if c, err = br.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+		size |= int64(c&0x7f) << shift
+	}
+
+	var baseTyp int
+	var base []byte
+	switch typ {
+	case objOfsDelta:
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = br.ReadByte(); err != nil {
+				return 0, nil, err
+			}
+			rel = (rel+1)<<7 | int64(c&0x7f)
+		}
+		if rel <= 0 || rel > off {
+			return 0, nil, fmt.Errorf("%s: bad delta offset", p.pack.Name())
+		}
+		if baseTyp, base, err = r.readPacked(p, off-rel); err != nil {
+			return 0, nil, err
+		}
+	case objRefDelta:
+		id := make([]byte, sha1.Size)
+		if _, err := io.ReadFull(br, id); err != nil {
+			return 0, nil, err
+		}
+		if baseTyp, base, err = r.readObject(hex.EncodeToString(id)); err != nil {
+			return 0, nil, err
+		}
+	case objCommit, objTree, objBlob, objTag:
+	default:
+		return 0, nil, fmt.Errorf("%s: unknown object type %d", p.pack.Name(), typ)
+	}
+
+	zr, err := zlib.NewReader(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer zr.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return 0, nil, err
+	}
+	if base == nil {
+		return typ, data, nil
+	}
+	data, err = applyDelta(base, data)
+	return baseTyp, data, err
+}
+
+var errBadDelta = errors.New("corrupt delta")
+
+// applyDelta rebuilds an object from its base and the copy and insert
+// instructions of a pack delta.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	varint := func() int {
+		v, shift := 0, 0
+		for len(delta) > 0 {
+			c := delta[0]
+			delta = delta[1:]
+			v |= int(c&0x7f) << shift
+			shift += 7
+			if c&0x80 == 0 {
+				break
+			}
+		}
+		return v
+	}
+	if varint() != len(base) {
+		return nil, errBadDelta
+	}
+	size := varint()
+	out := make([]byte, 0, size)
+
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0:
+			var off, size int
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, errBadDelta
+				}
+				if i < 4 {
+					off |= int(delta[0]) << (8 * i)
+				} else {
+					size |= int(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if off+size > len(base) {
+				return nil, errBadDelta
+			}
+			out = append(out, base[off:off+size]...)
+		case op != 0:
+			if int(op) > len(delta) {
+				return nil, errBadDelta
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, errBadDelta
+		}
+	}
+	if len(out) != size {
+		return nil, errBadDelta
+	}
+	return out, nil
+}
+
+// blobID is the object id git gives to size bytes of content read from r.
+func blobID(r io.Reader, size int64) (string, error) {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", size)
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"sync"
+)
+
+func checkGrep(pattern string) error {
+	if pattern == "" {
+		return nil
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("--grep: %v", err)
+	}
+	return nil
+}
+
+// grepTree leaves only the files of root whose contents match --grep and
+// the directories on the way to them.
+func grepTree(fsys fs.FS, root *node, opts options) []error {
+	re := regexp.MustCompile(opts.Grep)
+	var (
+		mu   sync.Mutex
+		hits = map[*node]int{}
+		errs []error
+	)
+	forEachFile(collectFiles("", root, nil), opts.Jobs, func(f fileRef) {
+		n, err := grepFile(fsys, f.path, re)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			errs = append(errs, err)
+			f.n.Error = err.Error()
+		} else {
+			hits[f.n] = n
+		}
+	})
+
+	keepFiles(root, func(n *node) bool {
+		if opts.GrepCount {
+			n.Hits = hits[n]
+		}
+		return hits[n] > 0
+	})
+	return errs
+}
+
+// grepFile counts the lines of name that match re. Files with a NUL byte
+// near the start are taken for binary and never match, like grep -I.
+func grepFile(fsys fs.FS, name string, re *regexp.Regexp) (int, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return 0, nil
+	}
+
+	hits := 0
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 && re.Match(bytes.TrimSuffix(line, []byte("\n"))) {
+			hits++
+		}
+		if err == io.EOF {
+			return hits, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
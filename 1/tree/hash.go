@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var hashers = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"md5":    md5.New,
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+}
+
+func checkHash(algo string) error {
+	if _, ok := hashers[algo]; algo != "" && !ok {
+		return fmt.Errorf("unknown hash %q", algo)
+	}
+	return nil
+}
+
+func fileDigest(fsys fs.FS, name, algo string) (string, error) {
+	newHash, ok := hashers[algo]
+	if !ok {
+		return "", fmt.Errorf("unknown hash %q", algo)
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return algo + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileRef is a file of the model together with its path inside the tree.
+type fileRef struct {
+	n    *node
+	path string
+}
+
+func collectFiles(dir string, parent *node, files []fileRef) []fileRef {
+	for _, n := range parent.Children {
+		p := path.Join(dir, n.Name)
+		if n.Type == typeFile && n.Error == "" {
+			files = append(files, fileRef{n: n, path: p})
+		}
+		files = collectFiles(p, n, files)
+	}
+	return files
+}
+
+// hashFiles computes the digests of files, files that cannot be read get
+// the error attached to their node.
+func hashFiles(fsys fs.FS, files []fileRef, algo string, jobs int) (map[*node]string, []error) {
+	var (
+		mu      sync.Mutex
+		digests = make(map[*node]string, len(files))
+		errs    []error
+	)
+	forEachFile(files, jobs, func(f fileRef) {
+		sum, err := fileDigest(fsys, f.path, algo)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			errs = append(errs, err)
+			f.n.Error = err.Error()
+		} else {
+			digests[f.n] = sum
+		}
+	})
+	return digests, errs
+}
+
+// forEachFile calls fn for files on a fixed number of workers, so no more
+// than jobs files are open at the same time.
+func forEachFile(files []fileRef, jobs int, fn func(f fileRef)) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	var wg sync.WaitGroup
+	queue := make(chan fileRef)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				fn(f)
+			}
+		}()
+	}
+	for _, f := range files {
+		queue <- f
+	}
+	close(queue)
+	wg.Wait()
+}
+
+type dupeGroup struct {
+	size  int64
+	hash  string
+	paths []string
+}
+
+// findDupes groups non-empty files with identical contents. Only files that
+// share their size with another one have to be hashed at all.
+func findDupes(fsys fs.FS, root *node, opts options) ([]dupeGroup, []error) {
+	bySize := map[int64][]fileRef{}
+	for _, f := range collectFiles("", root, nil) {
+		if f.n.Size > 0 {
+			bySize[f.n.Size] = append(bySize[f.n.Size], f)
+		}
+	}
+	var candidates []fileRef
+	for _, files := range bySize {
+		if len(files) > 1 {
+			candidates = append(candidates, files...)
+		}
+	}
+
+	algo := opts.Hash
+	if algo == "" {
+		algo = "sha256"
+	}
+	// what --hash has read already is not read again
+	digests := make(map[*node]string, len(candidates))
+	var unhashed []fileRef
+	for _, f := range candidates {
+		switch {
+		case opts.Hash != "" && f.n.Hash != "":
+			digests[f.n] = f.n.Hash
+		case f.n.Error == "":
+			unhashed = append(unhashed, f)
+		}
+	}
+	sums, errs := hashFiles(fsys, unhashed, algo, opts.Jobs)
+	for n, sum := range sums {
+		digests[n] = sum
+	}
+
+	byHash := map[string]*dupeGroup{}
+	for _, f := range candidates {
+		sum, ok := digests[f.n]
+		if !ok {
+			continue
+		}
+		g := byHash[sum]
+		if g == nil {
+			g = &dupeGroup{size: f.n.Size, hash: sum}
+			byHash[sum] = g
+		}
+		g.paths = append(g.paths, f.path)
+	}
+
+	var groups []dupeGroup
+	for _, g := range byHash {
+		if len(g.paths) > 1 {
+			sort.Strings(g.paths)
+			groups = append(groups, *g)
+		}
+	}
+	// the groups wasting the most space come first
+	sort.Slice(groups, func(i, j int) bool {
+		wi := groups[i].size * int64(len(groups[i].paths)-1)
+		wj := groups[j].size * int64(len(groups[j].paths)-1)
+		if wi != wj {
+			return wi > wj
+		}
+		return groups[i].paths[0] < groups[j].paths[0]
+	})
+	return groups, errs
+}
+
+func writeDupes(out io.Writer, groups []dupeGroup, opts options) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\n%s of duplicate files\n", plural(len(groups), "group", "groups"))
+	for _, g := range groups {
+		size := fmt.Sprintf("%db", g.size)
+		if opts.Human {
+			size = humanSize(g.size)
+		}
+		fmt.Fprintf(&sb, "%s x%d [%s]\n", size, len(g.paths), g.hash)
+		for _, p := range g.paths {
+			fmt.Fprintf(&sb, "\t%s\n", p)
+		}
+	}
+	_, err := io.WriteString(out, sb.String())
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+type ignoreRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreFile holds the rules of one .gitignore, base is the directory it
+// was found in relative to the tree root ("" for the root itself).
+type ignoreFile struct {
+	base  string
+	rules []ignoreRule
+}
+
+func readIgnoreFile(fsys fs.FS, name, base string) (*ignoreFile, error) {
+	f, err := fsys.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ign := &ignoreFile{base: base}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if rule, ok := parseIgnoreLine(sc.Text()); ok {
+			ign.rules = append(ign.rules, rule)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(ign.rules) == 0 {
+		return nil, nil
+	}
+	return ign, nil
+}
+
+func parseIgnoreLine(line string) (ignoreRule, bool) {
+	var rule ignoreRule
+
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || line[0] == '#' {
+		return rule, false
+	}
+	if line[0] == '!' {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// ignored reports whether rel (slash separated, relative to the tree root)
+// is excluded by the stack of ignore files, outermost first. As in git the
+// last matching rule wins, so nested files override their parents.
+func ignored(stack []*ignoreFile, rel string, isDir bool) bool {
+	result := false
+	for _, ign := range stack {
+		sub := rel
+		if ign.base != "" {
+			if !strings.HasPrefix(rel, ign.base+"/") {
+				continue
+			}
+			sub = rel[len(ign.base)+1:]
+		}
+		for _, rule := range ign.rules {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.match(sub) {
+				result = !rule.negate
+			}
+		}
+	}
+	return result
+}
+
+func (r ignoreRule) match(rel string) bool {
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], path.Base(rel))
+		return ok
+	}
+	return matchSegments(r.segments, strings.Split(rel, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchAny checks -P/-I style patterns: a pattern with a slash is matched
+// against the path from the root, anything else against the base name.
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		target := path.Base(rel)
+		if strings.Contains(p, "/") {
+			target = rel
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad pattern %q", p)
+		}
+	}
+	return nil
+}
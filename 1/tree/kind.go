@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// extTypes fill in for what http.DetectContentType cannot tell from the
+// contents alone, most source code sniffs as plain text.
+var extTypes = map[string]string{
+	".c":    "text/x-c",
+	".css":  "text/css",
+	".csv":  "text/csv",
+	".go":   "text/x-go",
+	".h":    "text/x-c",
+	".java": "text/x-java",
+	".js":   "text/javascript",
+	".json": "application/json",
+	".md":   "text/markdown",
+	".py":   "text/x-python",
+	".rs":   "text/x-rust",
+	".sh":   "application/x-sh",
+	".svg":  "image/svg+xml",
+	".tar":  "application/x-tar",
+	".toml": "application/toml",
+	".ts":   "text/x-typescript",
+	".xml":  "text/xml",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+}
+
+// fileKinds are the groups --only selects from, by content type prefix.
+var fileKinds = map[string][]string{
+	"archives":  {"application/zip", "application/x-gzip", "application/x-tar", "application/x-rar-compressed", "application/x-7z-compressed", "application/x-bzip2", "application/x-xz"},
+	"audio":     {"audio/"},
+	"documents": {"application/pdf", "application/postscript", "application/rtf"},
+	"fonts":     {"font/", "application/vnd.ms-fontobject"},
+	"images":    {"image/"},
+	"text":      {"text/", "application/json", "application/yaml", "application/toml", "application/x-sh"},
+	"video":     {"video/"},
+}
+
+func checkKinds(kinds []string) error {
+	for _, k := range kinds {
+		if _, ok := fileKinds[k]; !ok {
+			names := make([]string, 0, len(fileKinds))
+			for name := range fileKinds {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown file kind %q, use one of %s", k, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+func isKind(contentType string, kinds []string) bool {
+	for _, k := range kinds {
+		for _, prefix := range fileKinds[k] {
+			if strings.HasPrefix(contentType, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// detectTypes sniffs the content type of every file for --type and, with
+// --only, leaves out the files of other kinds.
+func detectTypes(fsys fs.FS, root *node, opts options) []error {
+	var (
+		mu    sync.Mutex
+		types = map[*node]string{}
+		errs  []error
+	)
+	forEachFile(collectFiles("", root, nil), opts.Jobs, func(f fileRef) {
+		ct, err := contentType(fsys, f.path)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			errs = append(errs, err)
+			f.n.Error = err.Error()
+		} else {
+			types[f.n] = ct
+		}
+	})
+
+	if opts.ShowType {
+		for n, ct := range types {
+			n.MIME = ct
+		}
+	}
+	if len(opts.Only) > 0 {
+		keepFiles(root, func(n *node) bool {
+			return isKind(types[n], opts.Only)
+		})
+	}
+	return errs
+}
+
+// contentType sniffs the start of name. The extension only decides when
+// the contents look like generic text, markup or binary data.
+func contentType(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	ct := http.DetectContentType(head[:n])
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	if ct == "text/plain" || ct == "text/xml" || ct == "application/octet-stream" {
+		if byExt, ok := extTypes[strings.ToLower(path.Ext(name))]; ok {
+			return byExt, nil
+		}
+	}
+	return ct, nil
+}
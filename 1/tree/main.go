@@ -1,89 +1,324 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 )
 
+type options struct {
+	All         bool
+	PrintFiles  bool
+	Format      string
+	MaxDepth    int
+	Prune       bool
+	Include     []string
+	Exclude     []string
+	GitIgnore   bool
+	DirSizes    bool
+	Human       bool
+	Strict      bool
+	FollowLinks bool
+	Jobs        int
+	Checksum    bool
+	Sort        string
+	Reverse     bool
+	DirsFirst   bool
+	Perms       bool
+	Owner       bool
+	Group       bool
+	Dates       bool
+	Hash        string
+	Dupes       bool
+	Report      bool
+	Stats       bool
+	Colors      *lsColors
+	FileLimit   int
+	SkipLarge   int
+	Stream      bool
+	Grep        string
+	GrepCount   bool
+	ShowType    bool
+	Only        []string
+	GitStatus   bool
+}
+
+func (o options) textOutput() bool {
+	return o.Format == "" || o.Format == "text"
+}
+
+// needsInfo reports whether every entry has to be stat'ed, not only files.
+func (o options) needsInfo() bool {
+	return o.Sort == "mtime" || o.Perms || o.Owner || o.Group || o.Dates
+}
+
+// readsFiles reports whether the options look at the contents of files.
+func (o options) readsFiles() bool {
+	return o.Hash != "" || o.Dupes || o.Grep != "" || o.ShowType || len(o.Only) > 0 || o.GitStatus || o.Checksum
+}
+
 func main() {
-	out := os.Stdout
-	if !(len(os.Args) == 2 || len(os.Args) == 3) {
-		panic("usage go run main.go . [-f]")
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run is the tree command minus the process around it, it returns the exit
+// status.
+func run(args []string, out, errOut io.Writer) int {
+	color := false
+	if f, ok := out.(*os.File); ok {
+		color = isTerminal(f) && os.Getenv("NO_COLOR") == ""
+	}
+	c, err := parseArgs(args, options{Format: "text", Jobs: runtime.NumCPU(), Report: true}, color)
+	if errors.Is(err, flag.ErrHelp) {
+		printUsage(out)
+		return 0
 	}
-	path := os.Args[1]
-	printFiles := len(os.Args) == 3 && os.Args[2] == "-f"
-	err := dirTree(out, path, printFiles)
 	if err != nil {
-		panic(err.Error())
+		fmt.Fprintf(errOut, "tree: %v\n%s", err, usageLine)
+		return 2
+	}
+	opts := c.opts
+	if c.color {
+		opts.Colors = parseLSColors(os.Getenv("LS_COLORS"))
+	}
+
+	status := 0
+	fail := func(err error) {
+		fmt.Fprintln(errOut, "tree:", err)
+		status = 2
+	}
+	walkFailed := func(err error) {
+		if opts.Strict {
+			fmt.Fprintln(errOut, "tree:", err)
+		}
+		if status == 0 {
+			status = 1
+		}
 	}
+	switch {
+	case c.manifestOut != "":
+		if err := writeManifest(c.manifestOut, c.roots[0], opts); err != nil {
+			fail(err)
+		}
+	case c.manifestIn != "":
+		drift, err := verifyManifest(out, c.manifestIn, c.roots[0], opts)
+		if err != nil {
+			fail(err)
+		} else if drift {
+			status = 1
+		}
+	case c.apply != "":
+		if err := applyLayoutFile(c.apply, c.roots[0]); err != nil {
+			fail(err)
+		}
+	case c.watch:
+		stop := make(chan struct{})
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		go func() {
+			<-sig
+			close(stop)
+		}()
+		if err := watchTree(out, c.roots[0], opts, c.interval, stop); err != nil {
+			fail(err)
+		}
+	case c.diff:
+		walkErr, err := diffTree(out, c.roots[0], c.roots[1], opts)
+		if err != nil {
+			fail(err)
+		} else if walkErr != nil {
+			walkFailed(walkErr)
+		}
+	default:
+		// bad options are reported once and not again for every root
+		if err := checkListing(opts); err != nil {
+			fail(err)
+			break
+		}
+		// one bad root does not keep the others from being listed
+		for i, root := range c.roots {
+			// the text format leaves out the root, which is ambiguous here
+			if len(c.roots) > 1 && opts.textOutput() {
+				if i > 0 {
+					fmt.Fprintln(out)
+				}
+				fmt.Fprintln(out, root)
+			}
+			walkErr, err := writeTree(out, root, opts)
+			if err != nil {
+				fail(err)
+			} else if walkErr != nil {
+				walkFailed(walkErr)
+			}
+		}
+	}
+	return status
 }
 
 func dirTree(out io.Writer, path string, printFiles bool) error {
-	printFilesInDir(out, path, "", printFiles)
-	return nil
+	return dirTreeWithOptions(out, path, options{PrintFiles: printFiles})
 }
 
-func getFileSize(path string) (int64, error) {
-	fi, err := os.Stat(path)
+// dirTreeWithOptions renders the tree of path. Entries that could not be
+// read are marked inline and only make it fail in strict mode.
+func dirTreeWithOptions(out io.Writer, path string, opts options) error {
+	walkErr, err := writeTree(out, path, opts)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return fi.Size(), nil
+	if opts.Strict {
+		return walkErr
+	}
+	return nil
 }
 
-func getFileSizeStr(path string) string {
-
-	fi, _ := os.Stat(path)
-
-	if fi.IsDir() {
-		return ""
+// dirTreeFS is dirTreeWithOptions for trees that do not come from disk:
+// archives, embedded files or in-memory fixtures.
+func dirTreeFS(out io.Writer, fsys fs.FS, opts options) error {
+	walkErr, err := writeTreeFS(out, fsys, ".", opts)
+	if err != nil {
+		return err
+	}
+	if opts.Strict {
+		return walkErr
 	}
+	return nil
+}
 
-	bytes, err := getFileSize(path)
+// writeTree reports failures below the root separately from the ones that
+// stopped it from producing any output.
+func writeTree(out io.Writer, path string, opts options) (walkErr, err error) {
+	fsys, closer, err := openSource(path, opts.readsFiles())
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	if bytes == 0 {
-		return " (empty)"
+	if closer != nil {
+		defer closer.Close()
 	}
-	return fmt.Sprintf(" (%db)", bytes)
+	return writeTreeFS(out, fsys, filepath.Base(path), opts)
 }
 
-func printFilesInDir(out io.Writer, dir, prefix string, printFiles bool) {
-	initFiles, _ := os.ReadDir(dir)
-
-	files := make([]os.DirEntry, 0, len(initFiles))
+func writeTreeFS(out io.Writer, fsys fs.FS, name string, opts options) (walkErr, err error) {
+	if opts.Stream {
+		return streamTree(out, fsys, opts)
+	}
+	if opts.Hash != "" || opts.Grep != "" || opts.ShowType || len(opts.Only) > 0 || opts.GitStatus {
+		opts.PrintFiles = true
+	}
+	render, err := lookupRenderer(opts.Format)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, file := range initFiles {
-		if file.IsDir() {
-			files = append(files, file)
-		} else if printFiles {
-			files = append(files, file)
-		}
+	if err := checkOptions(opts); err != nil {
+		return nil, err
 	}
 
-	for i, file := range files {
+	// duplicates and statistics look at all files, not only the listed ones
+	buildOpts := opts
+	if opts.Dupes || opts.Stats {
+		buildOpts.PrintFiles = true
+	}
+	root, err := buildTree(fsys, ".", buildOpts)
+	if root == nil {
+		return nil, err
+	}
+	root.Name = name
 
-		name := file.Name()
-		parent := filepath.Join(dir, name)
-		branch := "├"
-		newPrefix := prefix + "│\t"
+	if opts.Grep != "" {
+		err = appendWalkErrors(err, grepTree(fsys, root, opts))
+	}
+	if opts.ShowType || len(opts.Only) > 0 {
+		err = appendWalkErrors(err, detectTypes(fsys, root, opts))
+	}
+	if opts.GitStatus {
+		err = appendWalkErrors(err, markGitStatus(fsys, root))
+	}
 
-		if i == len(files)-1 {
-			branch = "└"
-			newPrefix = prefix + "\t"
+	if opts.Hash != "" {
+		digests, errs := hashFiles(fsys, collectFiles("", root, nil), opts.Hash, opts.Jobs)
+		for n, sum := range digests {
+			n.Hash = sum
 		}
+		err = appendWalkErrors(err, errs)
+	}
+	var dupes []dupeGroup
+	if opts.Dupes {
+		var errs []error
+		dupes, errs = findDupes(fsys, root, opts)
+		err = appendWalkErrors(err, errs)
+	}
+	var st treeStats
+	if opts.Stats {
+		st = collectStats(root)
+	}
+	if !opts.PrintFiles {
+		dropFiles(root)
+	}
+	if opts.FileLimit > 0 {
+		limitEntries(root, opts.FileLimit)
+	}
 
-		if !file.IsDir() && printFiles {
-			name = name + getFileSizeStr(parent)
+	if err := render(out, root, opts); err != nil {
+		return nil, err
+	}
+	if !opts.textOutput() {
+		return err, nil
+	}
+	if opts.Report {
+		if !opts.Stats {
+			st = collectStats(root)
 		}
+		if err := writeReport(out, st, opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Stats {
+		if err := writeStats(out, st, opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Dupes {
+		if err := writeDupes(out, dupes, opts); err != nil {
+			return nil, err
+		}
+	}
+	return err, nil
+}
 
-		out.Write([]byte(fmt.Sprintf("%s%s───%s\n", prefix, branch, name)))
-
-		printFilesInDir(out, path.Join(dir, file.Name()), newPrefix, printFiles)
+// checkListing is everything writeTreeFS checks before it prints anything.
+func checkListing(opts options) error {
+	if opts.Stream {
+		if err := streamConflicts(opts); err != nil {
+			return err
+		}
+	} else if _, err := lookupRenderer(opts.Format); err != nil {
+		return err
+	}
+	return checkOptions(opts)
+}
 
+func checkOptions(opts options) error {
+	if err := checkSort(opts.Sort); err != nil {
+		return err
+	}
+	if err := checkHash(opts.Hash); err != nil {
+		return err
+	}
+	if err := checkKinds(opts.Only); err != nil {
+		return err
+	}
+	if err := checkGrep(opts.Grep); err != nil {
+		return err
+	}
+	if err := checkPatterns(opts.Include); err != nil {
+		return err
 	}
+	return checkPatterns(opts.Exclude)
 }
@@ -1,8 +1,21 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 const testFullResult = `├───project
@@ -73,3 +86,1069 @@ func TestTreeDir(t *testing.T) {
 		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testDirResult)
 	}
 }
+
+const testJSONResult = `{
+  "name": "project",
+  "type": "directory",
+  "size": 0,
+  "children": [
+    {
+      "name": "file.txt",
+      "type": "file",
+      "size": 19
+    },
+    {
+      "name": "gopher.png",
+      "type": "file",
+      "size": 70372
+    }
+  ]
+}
+`
+
+func TestTreeJSON(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata/project", options{PrintFiles: true, Format: "json"})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != testJSONResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testJSONResult)
+	}
+}
+
+const testDepthResult = `├───project
+├───static
+│	├───a_lorem
+│	├───css
+│	├───html
+│	├───js
+│	└───z_lorem
+└───zline
+	└───lorem
+`
+
+func TestTreeDepth(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata", options{MaxDepth: 2})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != testDepthResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testDepthResult)
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	parse := func(base string, lines ...string) *ignoreFile {
+		ign := &ignoreFile{base: base}
+		for _, l := range lines {
+			if rule, ok := parseIgnoreLine(l); ok {
+				ign.rules = append(ign.rules, rule)
+			}
+		}
+		return ign
+	}
+	stack := []*ignoreFile{
+		parse("", "# comment", "node_modules/", "*.log", "!keep.log", "/build", "docs/**/*.tmp"),
+		parse("src", "gen", "!*.log"),
+	}
+	cases := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"node_modules", true, true},
+		{"node_modules", false, false},
+		{"a/node_modules", true, true},
+		{"debug.log", false, true},
+		{"keep.log", false, false},
+		{"build", true, true},
+		{"src/build", true, false},
+		{"docs/x.tmp", false, true},
+		{"docs/a/b/x.tmp", false, true},
+		{"src/gen", true, true},
+		{"src/trace.log", false, false},
+		{"main.go", false, false},
+	}
+	for _, c := range cases {
+		if got := ignored(stack, c.rel, c.isDir); got != c.want {
+			t.Errorf("ignored(%q, %v) = %v, expected %v", c.rel, c.isDir, got, c.want)
+		}
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	cases := map[int64]string{
+		19:            "19b",
+		1024:          "1.0KiB",
+		70372:         "68.7KiB",
+		5 << 20:       "5.0MiB",
+		3<<30 + 1<<29: "3.5GiB",
+	}
+	for size, want := range cases {
+		if got := humanSize(size); got != want {
+			t.Errorf("humanSize(%d) = %q, expected %q", size, got, want)
+		}
+	}
+}
+
+const testDuResult = `├───project (70391b)
+├───static (281583b)
+└───zline (140744b)
+`
+
+func TestTreeDu(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata", options{MaxDepth: 1, DirSizes: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != testDuResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testDuResult)
+	}
+}
+
+func TestTreeMissingRoot(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTree(out, "testdata/missing", true)
+	if err == nil {
+		t.Errorf("test for error Failed - expected error for missing root")
+	}
+	if out.Len() != 0 {
+		t.Errorf("test for error Failed - unexpected output %q", out.String())
+	}
+}
+
+const testLinksResult = `├───a
+│	└───b
+│		├───f.txt (3b)
+│		└───up -> .. [recursive, not followed]
+└───alink -> a
+	└───b
+		├───f.txt (3b)
+		└───up -> .. [recursive, not followed]
+`
+
+func TestTreeFollowLinks(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a", "b", "f.txt"), []byte("abc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(dir, "a", "b", "up")); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+	if err := os.Symlink("a", filepath.Join(dir, "alink")); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, dir, options{PrintFiles: true, FollowLinks: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != testLinksResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testLinksResult)
+	}
+}
+
+func TestTreeMapFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"project/file.txt":   {Data: []byte("hello")},
+		"project/gopher.png": {Data: []byte{}},
+		"zline/empty/a.txt":  {Data: []byte("a")},
+	}
+	expected := `├───project
+│	├───file.txt (5b)
+│	└───gopher.png (empty)
+└───zline
+	└───empty
+		└───a.txt (1b)
+`
+	out := new(bytes.Buffer)
+	err := dirTreeFS(out, fsys, options{PrintFiles: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != expected {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, expected)
+	}
+}
+
+// testdataTar returns testdata as a tar archive.
+func testdataTar(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	err := filepath.Walk("testdata", func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == "testdata" {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name, _ = filepath.Rel("testdata", p)
+		if err := tw.WriteHeader(hdr); err != nil || fi.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTreeTarFS(t *testing.T) {
+	tfs, err := newTarFS(bytes.NewBuffer(testdataTar(t)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if err := dirTreeFS(out, tfs, options{PrintFiles: true}); err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != testFullResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testFullResult)
+	}
+}
+
+func TestTreeTarContents(t *testing.T) {
+	data := testdataTar(t)
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "testdata.tar")
+	gzipped := filepath.Join(dir, "testdata.tar.gz")
+	gz := new(bytes.Buffer)
+	zw := gzip.NewWriter(gz)
+	zw.Write(data)
+	zw.Close()
+	if err := os.WriteFile(plain, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gzipped, gz.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "└───gopher.png (70372b) [crc32:26524903]\n"
+	for _, name := range []string{plain, gzipped} {
+		out := new(bytes.Buffer)
+		err := dirTreeWithOptions(out, name, options{Hash: "crc32", Include: []string{"*.png"}, Strict: true})
+		if err != nil {
+			t.Errorf("test for OK Failed - error: %v", err)
+		}
+		result := out.String()
+		if !strings.Contains(result, expected) {
+			t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected a line:\n%v", result, expected)
+		}
+	}
+
+	// a tar on disk is read in place, of a gzipped one only the headers are
+	// kept unless the contents are asked for
+	fsys, closer, err := openSource(plain, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	if b, err := fs.ReadFile(fsys, "project/file.txt"); err != nil || len(b) == 0 {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	fsys, _, err = openSource(gzipped, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(fsys, "project/file.txt"); !errors.Is(err, errNotLoaded) {
+		t.Errorf("test for OK Failed - expected %v, got %v", errNotLoaded, err)
+	}
+}
+
+func TestTreeParallel(t *testing.T) {
+	for _, jobs := range []int{2, 4, 16} {
+		out := new(bytes.Buffer)
+		err := dirTreeWithOptions(out, "testdata", options{PrintFiles: true, DirSizes: true, Jobs: jobs})
+		if err != nil {
+			t.Errorf("test for OK Failed - error: %v", err)
+		}
+		expected := new(bytes.Buffer)
+		dirTreeWithOptions(expected, "testdata", options{PrintFiles: true, DirSizes: true})
+		if out.String() != expected.String() {
+			t.Errorf("test for %d jobs Failed - results not match\nGot:\n%v\nExpected:\n%v", jobs, out, expected)
+		}
+	}
+}
+
+func TestTreeDiff(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		filepath.Join(a, "same.txt"):      "abc",
+		filepath.Join(b, "same.txt"):      "abc",
+		filepath.Join(a, "edited.txt"):    "abc",
+		filepath.Join(b, "edited.txt"):    "abd",
+		filepath.Join(a, "old", "x.txt"):  "x",
+		filepath.Join(b, "docs", "y.txt"): "yy",
+	}
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := `├───[+] docs
+│	└───[+] y.txt (2b)
+├───[~] edited.txt (3b)
+├───[-] old
+│	└───[-] x.txt (1b)
+└───same.txt (3b)
+
+2 added, 2 removed, 1 changed
+`
+	out := new(bytes.Buffer)
+	_, err := diffTree(out, a, b, options{Checksum: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != expected {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, expected)
+	}
+}
+
+const testSortResult = `├───a_lorem (140744b)
+│	├───ipsum (70372b)
+│	│	└───gopher.png (70372b)
+│	├───gopher.png (70372b)
+│	└───dolor.txt (empty)
+├───z_lorem (140744b)
+│	├───ipsum (70372b)
+│	│	└───gopher.png (70372b)
+│	├───gopher.png (70372b)
+│	└───dolor.txt (empty)
+├───html (57b)
+│	└───index.html (57b)
+├───css (28b)
+│	└───body.css (28b)
+├───js (10b)
+│	└───site.js (10b)
+└───empty.txt (empty)
+`
+
+func TestTreeSort(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata/static", options{PrintFiles: true, DirSizes: true, Sort: "size", DirsFirst: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != testSortResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testSortResult)
+	}
+}
+
+const testMarkdownResult = `- **a\_lorem/**
+  - dolor.txt (empty)
+  - gopher.png (70372b)
+  - **ipsum/**
+    - gopher.png (70372b)
+- **css/**
+  - body.css (28b)
+`
+
+func TestTreeMarkdown(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata/static", options{PrintFiles: true, Format: "md", Include: []string{"*.png", "*.txt", "*.css"}, Exclude: []string{"z_lorem", "empty.txt"}, Prune: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != testMarkdownResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testMarkdownResult)
+	}
+}
+
+func TestTreeMetaColumns(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 30, 0, 0, time.Local)
+	fsys := fstest.MapFS{
+		"bin":        {Mode: fs.ModeDir | 0o755, ModTime: mtime},
+		"bin/run.sh": {Data: []byte("#!/bin/sh\n"), Mode: 0o755, ModTime: mtime},
+		"readme.md":  {Data: []byte("hi"), Mode: 0o600, ModTime: mtime.Add(time.Hour)},
+	}
+	expected := `drwxr-xr-x 2024-05-01 12:30  ├───bin
+-rwxr-xr-x 2024-05-01 12:30  │	└───run.sh (10b)
+-rw------- 2024-05-01 13:30  └───readme.md (2b)
+`
+	out := new(bytes.Buffer)
+	err := dirTreeFS(out, fsys, options{PrintFiles: true, Perms: true, Dates: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != expected {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, expected)
+	}
+}
+
+const testDupesResult = `
+1 group of duplicate files
+70372b x3 [crc32:26524903]
+	project/gopher.png
+	zline/lorem/gopher.png
+	zline/lorem/ipsum/gopher.png
+`
+
+func TestTreeDupes(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata", options{PrintFiles: true, Dupes: true, Hash: "crc32", Exclude: []string{"static"}, Jobs: 2})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if !strings.Contains(result, "└───gopher.png (70372b) [crc32:26524903]\n") || !strings.HasSuffix(result, testDupesResult) {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected suffix:\n%v", result, testDupesResult)
+	}
+
+	// the digests of --hash are reused
+	fsys := openLog{newOSFS("testdata"), map[string]int{}}
+	out.Reset()
+	err = dirTreeFS(out, fsys, options{Dupes: true, Hash: "crc32", Exclude: []string{"static"}})
+	if err != nil || !strings.HasSuffix(out.String(), testDupesResult) || fsys.opened["project/gopher.png"] != 1 {
+		t.Errorf("test for OK Failed - error %v, gopher.png opened %d times\nGot:\n%v", err, fsys.opened["project/gopher.png"], out)
+	}
+}
+
+func TestTreeHash(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata/project", options{Hash: "crc32"})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if !strings.Contains(result, "└───gopher.png (70372b) [crc32:26524903]\n") {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected a line with:\n%v", result, "gopher.png (70372b) [crc32:26524903]")
+	}
+}
+
+// openLog records the names opened in the file system it wraps.
+type openLog struct {
+	fs.FS
+	opened map[string]int
+}
+
+func (l openLog) Open(name string) (fs.File, error) {
+	l.opened[name]++
+	return l.FS.Open(name)
+}
+
+func TestWalkTree(t *testing.T) {
+	var visited []string
+	fsys := openLog{newOSFS("testdata"), map[string]int{}}
+	err := walkFS(fsys, options{PrintFiles: true}, func(e treeEntry) error {
+		visited = append(visited, fmt.Sprintf("%d %v %s", e.Depth, e.Last, e.Path))
+		switch e.Path {
+		case "static":
+			return fs.SkipDir
+		case "zline/lorem/dolor.txt":
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	expected := []string{
+		"1 false project",
+		"2 false project/file.txt",
+		"2 true project/gopher.png",
+		"1 false static",
+		"1 false zline",
+		"2 false zline/empty.txt",
+		"2 true zline/lorem",
+		"3 false zline/lorem/dolor.txt",
+	}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", visited, expected)
+	}
+	for _, name := range []string{"static", "zline/lorem/ipsum"} {
+		if fsys.opened[name] > 0 {
+			t.Errorf("test for OK Failed - skipped directory %s was read", name)
+		}
+	}
+
+	err = walkFS(fsys, options{PrintFiles: true, Only: []string{"images"}}, func(e treeEntry) error {
+		return nil
+	})
+	if err == nil || err.Error() != "walkFS does not apply --type and --only" {
+		t.Errorf("test for --only Failed - expected an error, got %v", err)
+	}
+}
+
+const testStatsResult = `├───html
+│	└───index.html (57b)
+└───js
+	└───site.js (10b)
+
+2 directories, 2 files
+
+extension  files  bytes
+.html          1    57b
+.js            1    10b
+
+largest files
+57b  html/index.html
+10b  js/site.js
+`
+
+func TestTreeStats(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata/static", options{PrintFiles: true, Report: true, Stats: true, Include: []string{"*.html", "*.js"}, Prune: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != testStatsResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testStatsResult)
+	}
+}
+
+func TestTreeColors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"bin/run":         {Data: []byte("x"), Mode: 0o755},
+		"img/logo.png":    {Data: []byte("x"), Mode: 0o644},
+		"dist/app.tar.gz": {Data: []byte("x"), Mode: 0o644},
+	}
+	expected := "├───\x1b[34mbin\x1b[0m\n" +
+		"│	└───\x1b[32mrun\x1b[0m (1b)\n" +
+		"├───\x1b[34mdist\x1b[0m\n" +
+		"│	└───\x1b[31mapp.tar.gz\x1b[0m (1b)\n" +
+		"└───\x1b[34mimg\x1b[0m\n" +
+		"	└───\x1b[35mlogo.png\x1b[0m (1b)\n"
+	out := new(bytes.Buffer)
+	colors := parseLSColors("di=34:ex=32:*.png=35:*.gz=33:*.tar.gz=31")
+	err := dirTreeFS(out, fsys, options{PrintFiles: true, Colors: colors})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != expected {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%q\nExpected:\n%q", result, expected)
+	}
+}
+
+// syncBuffer lets the test read what the watcher goroutine writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWatchTree(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "old.txt"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(syncBuffer)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- watchTree(out, dir, options{PrintFiles: true}, 10*time.Millisecond, stop)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), "└───old.txt (1b)") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := os.Rename(filepath.Join(dir, "old.txt"), filepath.Join(dir, "new.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "├───[+] new.txt (1b)\n└───[-] old.txt (1b)\n\n1 added, 1 removed, 0 changed\n"
+	for !strings.HasSuffix(out.String(), expected) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	if result := out.String(); !strings.HasSuffix(result, expected) {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected suffix:\n%v", result, expected)
+	}
+}
+
+func TestApplyLayout(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "skeleton")
+	if err := applyLayout(strings.NewReader(testFullResult+"\n3 directories, 5 files\n"), dir); err != nil {
+		t.Fatalf("test for OK Failed - error: %v", err)
+	}
+	out := new(bytes.Buffer)
+	if err := dirTree(out, dir, true); err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != testFullResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testFullResult)
+	}
+
+	annotated := `├───file.txt (19b) [md5:0f1e2d] [2 hits] [staged, modified]
+├───gopher.png (68.7KiB, image/png)
+├───loop [recursive, not followed]
+└───big [more than 1,200 entries, not read]
+`
+	entries, err := parseLayout(strings.NewReader(annotated))
+	want := []layoutEntry{
+		{depth: 1, name: "file.txt", size: 19},
+		{depth: 1, name: "gopher.png", size: 70348},
+		{depth: 1, name: "loop", isDir: true},
+		{depth: 1, name: "big", isDir: true},
+	}
+	if err != nil || !reflect.DeepEqual(entries, want) {
+		t.Errorf("test for annotations Failed - error %v\nGot:\n%+v\nExpected:\n%+v", err, entries, want)
+	}
+
+	outside := t.TempDir()
+	bad := map[string]string{
+		"├───a (1b)\n│	└───b\n":       "line 2: b is inside a file",
+		"├───a\n		└───b\n":            "line 2: b is nested too deep",
+		"└───..\n":                    "line 1: bad name \"..\"",
+		"just text\n":                 "line 1: not a tree entry",
+		"└───x [permission denied]\n": "line 1: unexpected annotation \"[permission denied]\"",
+		"├───a\n└───a (1b)\n":         "line 2: a is listed twice",
+		"├───evil -> " + outside + "\n└───evil\n	└───pwned.txt (5b)\n": "line 2: evil is listed twice",
+	}
+	for layout, expected := range bad {
+		err := applyLayout(strings.NewReader(layout), t.TempDir())
+		if err == nil || err.Error() != expected {
+			t.Errorf("test for bad layout Failed - expected %q, got %v", expected, err)
+		}
+	}
+
+	// a link already in place is not followed either
+	dest := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dest, "evil")); err != nil {
+		t.Fatal(err)
+	}
+	err = applyLayout(strings.NewReader("└───evil\n	└───pwned.txt (5b)\n"), dest)
+	if expected := filepath.Join(dest, "evil") + ": exists and is not a directory"; err == nil || err.Error() != expected {
+		t.Errorf("test for bad layout Failed - expected %q, got %v", expected, err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "pwned.txt")); err == nil {
+		t.Errorf("test for bad layout Failed - file created outside the target directory")
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "deploy")
+	if err := applyLayout(strings.NewReader(testFullResult), dir); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "manifest.json")
+	if err := writeManifest(name, dir, options{Hash: "md5"}); err != nil {
+		t.Fatalf("test for OK Failed - error: %v", err)
+	}
+
+	out := new(bytes.Buffer)
+	drift, err := verifyManifest(out, name, dir, options{})
+	if err != nil || drift || out.String() != "0 missing, 0 extra, 0 modified\n" {
+		t.Errorf("test for clean tree Failed - drift %v, error %v, output:\n%v", drift, err, out)
+	}
+
+	os.Remove(filepath.Join(dir, "zzfile.txt"))
+	os.WriteFile(filepath.Join(dir, "project", "file.txt"), []byte("nineteen bytes long"), 0o644)
+	os.WriteFile(filepath.Join(dir, "static", "new.txt"), nil, 0o644)
+	expected := `modified  project/file.txt (content)
+extra     static/new.txt
+missing   zzfile.txt
+1 missing, 1 extra, 1 modified
+`
+	out.Reset()
+	drift, err = verifyManifest(out, name, dir, options{})
+	if err != nil || !drift || out.String() != expected {
+		t.Errorf("test for drift Failed - drift %v, error %v\nGot:\n%v\nExpected:\n%v", drift, err, out, expected)
+	}
+	// a manifest kept inside the tree is not part of it, written twice so
+	// the second snapshot already finds the first one on disk
+	inside := filepath.Join(dir, "manifest.json")
+	for i := 0; i < 2; i++ {
+		if err := writeManifest(inside, dir, options{}); err != nil {
+			t.Fatalf("test for manifest inside Failed - error: %v", err)
+		}
+	}
+	out.Reset()
+	drift, err = verifyManifest(out, inside, dir, options{})
+	if err != nil || drift || out.String() != "0 missing, 0 extra, 0 modified\n" {
+		t.Errorf("test for manifest inside Failed - drift %v, error %v, output:\n%v", drift, err, out)
+	}
+}
+
+const testFileLimitResult = `├───a_lorem [more than 2 entries, not read]
+├───css
+│	└───body.css (28b)
+└───… 4 more entries
+`
+
+func TestTreeFileLimit(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, "testdata/static", options{PrintFiles: true, FileLimit: 2, SkipLarge: 2})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != testFileLimitResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testFileLimitResult)
+	}
+
+	var visited []string
+	err = walkFS(newOSFS("testdata/static"), options{PrintFiles: true, FileLimit: 2}, func(e treeEntry) error {
+		visited = append(visited, fmt.Sprintf("%d %v %s %s", e.Depth, e.Last, e.Type, e.Name))
+		return nil
+	})
+	expected := []string{
+		"1 false directory a_lorem",
+		"2 false file dolor.txt",
+		"2 false file gopher.png",
+		"2 true more … 1 more entry",
+		"1 false directory css",
+		"2 true file body.css",
+		"1 true more … 4 more entries",
+	}
+	if err != nil || !reflect.DeepEqual(visited, expected) {
+		t.Errorf("test for walkFS Failed - error %v\nGot:\n%v\nExpected:\n%v", err, visited, expected)
+	}
+
+	big := fstest.MapFS{}
+	for i := 0; i < 5; i++ {
+		big[fmt.Sprintf("d/%d", 4-i)] = &fstest.MapFile{}
+	}
+	if _, err := readDirLimit(big, "d", 4); err != errTooLarge {
+		t.Errorf("test for readDirLimit Failed - expected errTooLarge, got %v", err)
+	}
+	if entries, err := readDirLimit(big, "d", 5); err != nil || len(entries) != 5 || entries[0].Name() != "0" {
+		t.Errorf("test for readDirLimit Failed - error %v, %d entries", err, len(entries))
+	}
+
+	// --apply reads it back without the truncation line
+	entries, err := parseLayout(strings.NewReader(result))
+	if err != nil || len(entries) != 3 || entries[2].name != "body.css" {
+		t.Errorf("test for --apply Failed - error %v, entries %+v", err, entries)
+	}
+	if groupDigits(49950) != "49,950" || groupDigits(1234567) != "1,234,567" || groupDigits(999) != "999" {
+		t.Errorf("test for groupDigits Failed")
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a/.hidden", "a/file.txt", "b/.git/config"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+
+	cases := []struct {
+		args     []string
+		status   int
+		expected string
+	}{
+		{[]string{a, "-f", "--noreport"}, 0, "└───file.txt (1b)\n"},
+		{[]string{"-a", "--noreport", a, "-f"}, 0, "├───.hidden (1b)\n└───file.txt (1b)\n"},
+		{[]string{"-a", a, b}, 0, a + "\n\n0 directories\n\n" + b + "\n└───.git\n\n1 directory\n"},
+		{[]string{"--noreport", "--", "-f"}, 2, ""},
+		{[]string{"-L", "0", a}, 2, ""},
+		{[]string{"--diff", a}, 2, ""},
+		{[]string{"--watch", "--apply", "x", a}, 2, ""},
+		{[]string{"--bogus"}, 2, ""},
+		{[]string{"-o", "xml", a, b}, 2, ""},
+		{[]string{"--sort=bogus", a, b}, 2, ""},
+		{[]string{"-o", "bogus", a}, 2, ""},
+	}
+	for _, c := range cases {
+		out, errOut := new(bytes.Buffer), new(bytes.Buffer)
+		status := run(c.args, out, errOut)
+		if status != c.status || out.String() != c.expected {
+			t.Errorf("test for %q Failed - status %d, stderr %q\nGot:\n%v\nExpected:\n%v", c.args, status, errOut, out, c.expected)
+		}
+		if status == 2 && (!strings.HasPrefix(errOut.String(), "tree: ") || strings.Count(errOut.String(), "tree: ") > 1) {
+			t.Errorf("test for %q Failed - expected one message on stderr, got %q", c.args, errOut)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	if status := run([]string{"--help"}, out, new(bytes.Buffer)); status != 0 || !strings.Contains(out.String(), "-skip-large n") {
+		t.Errorf("test for --help Failed - status %d\nGot:\n%v", status, out)
+	}
+}
+
+func TestTreeStream(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a/.hidden":     {Data: []byte("x")},
+		"a/b.txt":       {Data: []byte("hello")},
+		"a/c/d.txt":     {Data: []byte("d")},
+		"a/c/skip.log":  {Data: []byte("log")},
+		"e/f/g/h.txt":   {Data: []byte("h")},
+		"z.txt":         {Data: []byte{}},
+		"zz/.gitignore": {Data: []byte("*.tmp\n")},
+		"zz/x.tmp":      {Data: []byte{}},
+	}
+	// fstest.MapFS lists directories sorted, so both modes must agree
+	for _, opts := range []options{
+		{PrintFiles: true},
+		{PrintFiles: true, All: true},
+		{PrintFiles: true, Exclude: []string{"*.log", "z.txt"}},
+		{PrintFiles: true, GitIgnore: true, Include: []string{"*.txt"}},
+		{MaxDepth: 2},
+		{PrintFiles: true, Human: true, Report: true},
+	} {
+		want, got := new(bytes.Buffer), new(bytes.Buffer)
+		if err := dirTreeFS(want, fsys, opts); err != nil {
+			t.Fatalf("test for %+v Failed - error: %v", opts, err)
+		}
+		opts.Stream = true
+		if err := dirTreeFS(got, fsys, opts); err != nil {
+			t.Errorf("test for %+v Failed - error: %v", opts, err)
+		}
+		if got.String() != want.String() {
+			t.Errorf("test for %+v Failed - results not match\nGot:\n%v\nExpected:\n%v", opts, got, want)
+		}
+	}
+
+	// more entries than one chunk, the last one is filtered out
+	big := fstest.MapFS{}
+	for i := 0; i < 2*streamChunk+10; i++ {
+		big[fmt.Sprintf("dir/%04d.txt", i)] = &fstest.MapFile{}
+	}
+	big["dir/zzzz.log"] = &fstest.MapFile{}
+	out := new(bytes.Buffer)
+	if err := dirTreeFS(out, big, options{PrintFiles: true, Stream: true, Report: true, Exclude: []string{"*.log"}}); err != nil {
+		t.Errorf("test for big Failed - error: %v", err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if n := strings.Count(out.String(), "├───"); n != 2*streamChunk+9 {
+		t.Errorf("test for big Failed - %d entries with ├", n)
+	}
+	if last := lines[len(lines)-4]; last != fmt.Sprintf("\t└───%04d.txt (empty)", 2*streamChunk+9) {
+		t.Errorf("test for big Failed - last entry %q", last)
+	}
+	if report := lines[len(lines)-2]; report != "1 directory, "+groupDigits(2*streamChunk+10)+" files" {
+		t.Errorf("test for big Failed - report %q", report)
+	}
+
+	if err := dirTreeFS(out, big, options{Stream: true, Sort: "size"}); err == nil {
+		t.Errorf("test for -U --sort Failed - expected error")
+	}
+}
+
+func TestTreeGrep(t *testing.T) {
+	fsys := fstest.MapFS{
+		"cmd/main.go":       {Data: []byte("package main\n\nfunc main() {\n\tdirTree()\n\tdirTree()\n}\n")},
+		"cmd/util.go":       {Data: []byte("package main\n")},
+		"docs/readme.md":    {Data: []byte("call dirTree")},
+		"empty/nothing.txt": {Data: []byte("no match here\n")},
+		"tree.bin":          {Data: []byte("\x00dirTree\n")},
+	}
+	expected := `├───cmd
+│	└───main.go (52b) [2 hits]
+└───docs
+	└───readme.md (12b) [1 hit]
+
+2 directories, 2 files
+`
+	out := new(bytes.Buffer)
+	err := dirTreeFS(out, fsys, options{Grep: `dir[A-Z]\w+`, GrepCount: true, Report: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != expected {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, expected)
+	}
+
+	out.Reset()
+	if err := dirTreeFS(out, fsys, options{Grep: "dirTree", Format: "json"}); err != nil {
+		t.Errorf("test for json Failed - error: %v", err)
+	}
+	if strings.Contains(out.String(), `"hits"`) || !strings.Contains(out.String(), `"readme.md"`) {
+		t.Errorf("test for json Failed - hits without --grep-count\nGot:\n%v", out)
+	}
+
+	if err := dirTreeFS(out, fsys, options{Grep: "("}); err == nil {
+		t.Errorf("test for bad pattern Failed - expected error")
+	}
+}
+
+func TestTreeType(t *testing.T) {
+	fsys := fstest.MapFS{
+		"img/logo.png":    {Data: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")},
+		"img/notes.txt":   {Data: []byte("hello\n")},
+		"src/main.go":     {Data: []byte("package main\n")},
+		"src/data.bin":    {Data: []byte{0, 1, 2}},
+		"src/vendor/x.gz": {Data: []byte{0x1f, 0x8b, 8, 0}},
+	}
+	expected := `├───img
+│	├───logo.png (16b, image/png)
+│	└───notes.txt (6b, text/plain)
+└───src
+	├───data.bin (3b, application/octet-stream)
+	├───main.go (13b, text/x-go)
+	└───vendor
+		└───x.gz (4b, application/x-gzip)
+`
+	out := new(bytes.Buffer)
+	err := dirTreeFS(out, fsys, options{ShowType: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != expected {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, expected)
+	}
+
+	expected = `├───img
+│	└───logo.png (16b)
+└───src
+	└───vendor
+		└───x.gz (4b)
+`
+	out.Reset()
+	err = dirTreeFS(out, fsys, options{Only: []string{"images", "archives"}})
+	if err != nil {
+		t.Errorf("test for --only Failed - error: %v", err)
+	}
+	result = out.String()
+	if result != expected {
+		t.Errorf("test for --only Failed - results not match\nGot:\n%v\nExpected:\n%v", result, expected)
+	}
+
+	if err := dirTreeFS(out, fsys, options{Only: []string{"pictures"}}); err == nil {
+		t.Errorf("test for unknown kind Failed - expected error")
+	}
+}
+
+func TestTreeGitStatus(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=tree", "-c", "user.email=tree@example.com", "-c", "commit.gpgsign=false"}, args...)...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL="+os.DevNull)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	write := func(name, data string) {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	big := strings.Repeat("the same line over and over\n", 200)
+	git("init", "-q")
+	write(".gitignore", "*.log\nbuild/\n")
+	write("clean.txt", "clean\n")
+	write("mod.txt", "v1\n")
+	write("both.txt", "a\n")
+	write("src/big.txt", big)
+	git("add", ".")
+	git("commit", "-q", "-m", "first")
+	// a second version so the pack stores big.txt as a delta
+	write("src/big.txt", big+"one more\n")
+	git("commit", "-q", "-a", "-m", "second")
+
+	src := t.TempDir()
+	git("-C", src, "init", "-q")
+	if err := os.WriteFile(filepath.Join(src, "s.txt"), []byte("s\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git("-C", src, "add", ".")
+	git("-C", src, "commit", "-q", "-m", "sub")
+	git("-c", "protocol.file.allow=always", "submodule", "add", "-q", src, "sub")
+	git("commit", "-q", "-m", "submodule")
+	git("init", "-q", "nested")
+	write("nested/n.txt", "n\n")
+
+	write("mod.txt", "v2 changed\n")
+	write("staged.txt", "new\n")
+	write("both.txt", "b\n")
+	git("add", "staged.txt", "both.txt")
+	write("both.txt", "cc\n")
+	write("new.txt", "untracked\n")
+	write("app.log", "log\n")
+	write("build/out.bin", "bin")
+	git("gc", "-q")
+	git("update-index", "--index-version", "4")
+
+	expected := `├───app.log (4b) [ignored]
+├───both.txt (3b) [staged, modified]
+├───build
+│	└───out.bin (3b) [ignored]
+├───clean.txt (6b)
+├───mod.txt (11b) [modified]
+├───nested [untracked]
+│	└───n.txt (2b)
+├───new.txt (10b) [untracked]
+├───src
+│	└───big.txt (5609b)
+├───staged.txt (4b) [staged]
+└───sub
+	└───s.txt (2b)
+`
+	out := new(bytes.Buffer)
+	err := dirTreeWithOptions(out, dir, options{GitStatus: true, Strict: true})
+	if err != nil {
+		t.Errorf("test for OK Failed - error: %v", err)
+	}
+	result := out.String()
+	if result != expected {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, expected)
+	}
+
+	// with hidden files the .git entries and .gitmodules show up unmarked
+	out.Reset()
+	err = dirTreeWithOptions(out, dir, options{GitStatus: true, Strict: true, All: true})
+	if err != nil || !strings.Contains(out.String(), "├───.gitmodules (") || strings.Count(out.String(), "[untracked]") != 2 {
+		t.Errorf("test for hidden files Failed - error %v\nGot:\n%v", err, out)
+	}
+
+	// the subdirectory sees the same repository
+	out.Reset()
+	err = dirTreeWithOptions(out, filepath.Join(dir, "build"), options{GitStatus: true, Strict: true})
+	if err != nil || out.String() != "└───out.bin (3b) [ignored]\n" {
+		t.Errorf("test for subdirectory Failed - error %v\nGot:\n%v", err, out)
+	}
+}
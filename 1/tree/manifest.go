@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const manifestVersion = 1
+
+// manifest is the --manifest snapshot of a tree: every entry with the
+// properties that matter for a deployed artifact. Modification times are
+// left out on purpose, copying files around changes them.
+type manifest struct {
+	Version int             `json:"version"`
+	Hash    string          `json:"hash"`
+	Entries []manifestEntry `json:"entries"`
+}
+
+type manifestEntry struct {
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Mode   string `json:"mode"`
+	Size   int64  `json:"size,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+// buildManifest snapshots fsys, leaving out the entry at skip, the path
+// of the manifest file itself when it is kept inside the tree.
+func buildManifest(fsys fs.FS, skip string, opts options) (*manifest, error) {
+	if err := checkOptions(opts); err != nil {
+		return nil, err
+	}
+	if opts.Hash == "" {
+		opts.Hash = "sha256"
+	}
+	opts.PrintFiles = true
+	opts.All = true
+	opts.Perms = true
+	opts.SkipLarge = 0
+
+	root, err := buildTree(fsys, ".", opts)
+	if root == nil {
+		return nil, err
+	}
+	files := collectFiles("", root, nil)
+	for i, f := range files {
+		if f.path == skip {
+			files = append(files[:i], files[i+1:]...)
+			break
+		}
+	}
+	digests, errs := hashFiles(fsys, files, opts.Hash, opts.Jobs)
+	if err := appendWalkErrors(err, errs); err != nil {
+		// a manifest with holes in it would verify as drift forever
+		return nil, err
+	}
+
+	m := &manifest{Version: manifestVersion, Hash: opts.Hash}
+	walkTree(root, func(e treeEntry) error {
+		if e.Path == skip {
+			return nil
+		}
+		me := manifestEntry{Path: e.Path, Type: e.Type, Mode: e.Mode, Target: e.Link}
+		if e.Type == typeFile {
+			me.Size = e.Size
+			me.Hash = digests[e.node]
+		}
+		m.Entries = append(m.Entries, me)
+		return nil
+	})
+	return m, nil
+}
+
+// writeManifest snapshots the tree of dir into the file name.
+func writeManifest(name, dir string, opts options) error {
+	fsys, closer, err := openSource(dir, true)
+	if err != nil {
+		return err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+	m, err := buildManifest(fsys, manifestPath(name, dir), opts)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// verifyManifest compares the tree of dir with the manifest in the file
+// name and writes one line per difference. It reports whether anything
+// drifted.
+func verifyManifest(out io.Writer, name, dir string, opts options) (bool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+	var want manifest
+	if err := json.Unmarshal(data, &want); err != nil {
+		return false, fmt.Errorf("%s: %v", name, err)
+	}
+	if want.Version != manifestVersion {
+		return false, fmt.Errorf("%s: unsupported manifest version %d", name, want.Version)
+	}
+
+	fsys, closer, err := openSource(dir, true)
+	if err != nil {
+		return false, err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+	opts.Hash = want.Hash
+	got, err := buildManifest(fsys, manifestPath(name, dir), opts)
+	if err != nil {
+		return false, err
+	}
+
+	current := make(map[string]manifestEntry, len(got.Entries))
+	for _, e := range got.Entries {
+		current[e.Path] = e
+	}
+
+	type drift struct {
+		kind, path, details string
+	}
+	var drifts []drift
+	var missing, extra, modified int
+	for _, w := range want.Entries {
+		g, ok := current[w.Path]
+		if !ok {
+			drifts = append(drifts, drift{kind: "missing", path: w.Path})
+			missing++
+			continue
+		}
+		delete(current, w.Path)
+		if diffs := entryDrift(w, g); len(diffs) > 0 {
+			drifts = append(drifts, drift{kind: "modified", path: w.Path, details: " (" + strings.Join(diffs, ", ") + ")"})
+			modified++
+		}
+	}
+	for p := range current {
+		drifts = append(drifts, drift{kind: "extra", path: p})
+		extra++
+	}
+	sort.Slice(drifts, func(i, j int) bool {
+		return drifts[i].path < drifts[j].path
+	})
+
+	var sb strings.Builder
+	for _, d := range drifts {
+		fmt.Fprintf(&sb, "%-9s %s%s\n", d.kind, d.path, d.details)
+	}
+	fmt.Fprintf(&sb, "%d missing, %d extra, %d modified\n", missing, extra, modified)
+	if _, err := io.WriteString(out, sb.String()); err != nil {
+		return false, err
+	}
+	return len(drifts) > 0, nil
+}
+
+// manifestPath returns where the manifest file name is inside the tree of
+// dir, or "" when it is kept elsewhere. Links are resolved on both sides,
+// the file itself may not exist yet.
+func manifestPath(name, dir string) string {
+	nameDir, err := filepath.EvalSymlinks(filepath.Dir(name))
+	if err != nil {
+		return ""
+	}
+	treeDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return ""
+	}
+	nameDir, _ = filepath.Abs(nameDir)
+	treeDir, _ = filepath.Abs(treeDir)
+	rel, err := filepath.Rel(treeDir, filepath.Join(nameDir, filepath.Base(name)))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+func entryDrift(want, got manifestEntry) []string {
+	var diffs []string
+	if want.Type != got.Type {
+		return []string{fmt.Sprintf("type %s -> %s", want.Type, got.Type)}
+	}
+	if want.Size != got.Size {
+		diffs = append(diffs, fmt.Sprintf("size %d -> %d", want.Size, got.Size))
+	}
+	if want.Hash != got.Hash {
+		diffs = append(diffs, "content")
+	}
+	if want.Mode != got.Mode {
+		diffs = append(diffs, fmt.Sprintf("mode %s -> %s", want.Mode, got.Mode))
+	}
+	if want.Target != got.Target {
+		diffs = append(diffs, fmt.Sprintf("target %s -> %s", want.Target, got.Target))
+	}
+	return diffs
+}
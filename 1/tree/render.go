@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type renderer func(out io.Writer, root *node, opts options) error
+
+var renderers = map[string]renderer{
+	"text": renderText,
+	"json": renderJSON,
+	"xml":  renderXML,
+	"yaml": renderYAML,
+	"html": renderHTML,
+	"md":   renderMarkdown,
+}
+
+func lookupRenderer(format string) (renderer, error) {
+	if format == "" {
+		return renderText, nil
+	}
+	render, ok := renderers[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+	return render, nil
+}
+
+func getFileSizeStr(n *node, opts options) string {
+	if n.isDir() && !opts.DirSizes || n.Type == typeLink && !opts.FollowLinks || n.Type == typeMore {
+		return ""
+	}
+	size := fmt.Sprintf("%db", n.Size)
+	if n.Size == 0 {
+		size = "empty"
+	} else if opts.Human {
+		size = humanSize(n.Size)
+	}
+	if n.MIME != "" {
+		size += ", " + n.MIME
+	}
+	return " (" + size + ")"
+}
+
+func getLinkStr(n *node) string {
+	if n.Link == "" {
+		return ""
+	}
+	return " -> " + n.Link
+}
+
+func getHashStr(n *node) string {
+	if n.Hash == "" {
+		return ""
+	}
+	return " [" + n.Hash + "]"
+}
+
+func getHitsStr(n *node) string {
+	if n.Hits == 0 {
+		return ""
+	}
+	return " [" + plural(n.Hits, "hit", "hits") + "]"
+}
+
+func getErrorStr(n *node) string {
+	if n.Cycle {
+		return " [recursive, not followed]"
+	}
+	if n.Unopened > 0 {
+		return " [more than " + plural(n.Unopened, "entry", "entries") + ", not read]"
+	}
+	if n.Error == "" {
+		return ""
+	}
+	return " [" + n.Error + "]"
+}
+
+// groupDigits formats n with thousands separators, 49950 as "49,950".
+func groupDigits(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0 && s[i-1] != '-'; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return "1 " + one
+	}
+	return groupDigits(n) + " " + many
+}
+
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%db", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit && exp < 5; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func renderText(out io.Writer, root *node, opts options) error {
+	p := &textPrinter{out: out, opts: opts}
+	p.measure(root)
+	return walkTree(root, p.line)
+}
+
+type textPrinter struct {
+	out    io.Writer
+	opts   options
+	widths []int
+}
+
+// metaColumns returns the -p/-u/-g/-D columns of n. They are printed in
+// front of the tree graphics, so they line up no matter how deep n is.
+func metaColumns(n *node, opts options) []string {
+	var cols []string
+	if opts.Perms {
+		cols = append(cols, n.Mode)
+	}
+	if opts.Owner {
+		cols = append(cols, n.Owner)
+	}
+	if opts.Group {
+		cols = append(cols, n.Group)
+	}
+	if opts.Dates {
+		cols = append(cols, n.MTime)
+	}
+	return cols
+}
+
+func (p *textPrinter) line(e treeEntry) error {
+	branch := "├"
+	if e.Last {
+		branch = "└"
+	}
+	name, mark := e.Name, statusMarks[e.Status]
+	if p.opts.Colors != nil {
+		name, mark = p.opts.Colors.paint(e.node, name), p.opts.Colors.paintStatus(e.Status)
+	}
+	_, err := fmt.Fprintf(p.out, "%s%s%s───%s%s%s%s%s%s%s%s\n", p.columns(e.node), e.prefix(), branch, mark, name,
+		getLinkStr(e.node), getFileSizeStr(e.node, p.opts), getHashStr(e.node), getHitsStr(e.node), getGitStr(e.node), getErrorStr(e.node))
+	return err
+}
+
+func (p *textPrinter) measure(root *node) {
+	walkTree(root, func(e treeEntry) error {
+		for i, col := range metaColumns(e.node, p.opts) {
+			if i == len(p.widths) {
+				p.widths = append(p.widths, 0)
+			}
+			if w := utf8.RuneCountInString(col); w > p.widths[i] {
+				p.widths[i] = w
+			}
+		}
+		return nil
+	})
+}
+
+func (p *textPrinter) columns(n *node) string {
+	cols := metaColumns(n, p.opts)
+	if len(cols) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for i, col := range cols {
+		sb.WriteString(col)
+		sb.WriteString(strings.Repeat(" ", p.widths[i]-utf8.RuneCountInString(col)+1))
+	}
+	sb.WriteString(" ")
+	return sb.String()
+}
+
+func renderJSON(out io.Writer, root *node, _ options) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(root)
+}
+
+func renderXML(out io.Writer, root *node, _ options) error {
+	if _, err := io.WriteString(out, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "  ")
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "\n")
+	return err
+}
+
+// renderYAML writes a block-style YAML document by hand, the model is
+// simple enough that pulling in a YAML library is not worth it.
+func renderYAML(out io.Writer, root *node, _ options) error {
+	var sb strings.Builder
+	writeYAMLNode(&sb, root, "", "")
+	_, err := io.WriteString(out, sb.String())
+	return err
+}
+
+func writeYAMLNode(sb *strings.Builder, n *node, first, indent string) {
+	fmt.Fprintf(sb, "%sname: %s\n", first, strconv.Quote(n.Name))
+	fmt.Fprintf(sb, "%stype: %s\n", indent, n.Type)
+	fmt.Fprintf(sb, "%ssize: %d\n", indent, n.Size)
+	if n.Link != "" {
+		fmt.Fprintf(sb, "%starget: %s\n", indent, strconv.Quote(n.Link))
+	}
+	if n.Cycle {
+		fmt.Fprintf(sb, "%scycle: true\n", indent)
+	}
+	for _, f := range [][2]string{{"mode", n.Mode}, {"owner", n.Owner}, {"group", n.Group}, {"mtime", n.MTime}, {"hash", n.Hash}, {"mime", n.MIME}} {
+		if f[1] != "" {
+			fmt.Fprintf(sb, "%s%s: %s\n", indent, f[0], strconv.Quote(f[1]))
+		}
+	}
+	if n.Hits > 0 {
+		fmt.Fprintf(sb, "%shits: %d\n", indent, n.Hits)
+	}
+	if n.More > 0 {
+		fmt.Fprintf(sb, "%smore: %d\n", indent, n.More)
+	}
+	if n.Unopened > 0 {
+		fmt.Fprintf(sb, "%sunopened: %d\n", indent, n.Unopened)
+	}
+	if n.Status != "" {
+		fmt.Fprintf(sb, "%sstatus: %s\n", indent, n.Status)
+	}
+	if n.Git != "" {
+		fmt.Fprintf(sb, "%sgit: %s\n", indent, strconv.Quote(n.Git))
+	}
+	if n.Error != "" {
+		fmt.Fprintf(sb, "%serror: %s\n", indent, strconv.Quote(n.Error))
+	}
+	if len(n.Children) == 0 {
+		return
+	}
+	fmt.Fprintf(sb, "%schildren:\n", indent)
+	for _, c := range n.Children {
+		writeYAMLNode(sb, c, indent+"  - ", indent+"    ")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+const htmlHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: monospace; }
+ul { list-style: none; margin: 0; padding-left: 1.5em; border-left: 1px dotted #999; }
+summary { cursor: pointer; font-weight: bold; }
+.size { color: #777; }
+.error { color: #c00; }
+.added { color: #080; }
+.removed { color: #c00; text-decoration: line-through; }
+.changed { color: #b60; }
+</style>
+</head>
+<body>
+<details open><summary>%s</summary>
+`
+
+const htmlFooter = `</details>
+</body>
+</html>
+`
+
+// renderHTML writes a standalone page where every directory is a
+// <details> element, so subtrees can be folded without any script.
+func renderHTML(out io.Writer, root *node, opts options) error {
+	bw := bufio.NewWriter(out)
+	name := html.EscapeString(root.Name)
+	fmt.Fprintf(bw, htmlHeader, name, name)
+	writeHTMLList(bw, root, opts)
+	io.WriteString(bw, htmlFooter)
+	return bw.Flush()
+}
+
+func writeHTMLList(bw *bufio.Writer, parent *node, opts options) {
+	if len(parent.Children) == 0 {
+		return
+	}
+	io.WriteString(bw, "<ul>\n")
+	for _, n := range parent.Children {
+		label := html.EscapeString(n.Name + getLinkStr(n))
+		if n.Status != "" {
+			label = fmt.Sprintf(`<span class="%s">%s</span>`, n.Status, label)
+		}
+		if size := getFileSizeStr(n, opts) + getHashStr(n) + getHitsStr(n) + getGitStr(n); size != "" {
+			label += `<span class="size">` + html.EscapeString(size) + "</span>"
+		}
+		if e := getErrorStr(n); e != "" {
+			label += `<span class="error">` + html.EscapeString(e) + "</span>"
+		}
+
+		if n.isDir() && len(n.Children) > 0 {
+			fmt.Fprintf(bw, "<li><details open><summary>%s</summary>\n", label)
+			writeHTMLList(bw, n, opts)
+			io.WriteString(bw, "</details></li>\n")
+		} else {
+			fmt.Fprintf(bw, "<li>%s</li>\n", label)
+		}
+	}
+	if parent.More > 0 {
+		fmt.Fprintf(bw, "<li class=\"size\">… %s</li>\n", plural(parent.More, "more entry", "more entries"))
+	}
+	io.WriteString(bw, "</ul>\n")
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`,
+	"[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`, "#", `\#`,
+)
+
+// renderMarkdown writes nested lists, directories in bold with a trailing
+// slash so they stand out in rendered docs.
+func renderMarkdown(out io.Writer, root *node, opts options) error {
+	bw := bufio.NewWriter(out)
+	err := walkTree(root, func(e treeEntry) error {
+		name := markdownEscaper.Replace(e.Name)
+		if e.isDir() {
+			name = "**" + name + "/**"
+		}
+		_, err := fmt.Fprintf(bw, "%s- %s%s%s%s%s%s%s%s\n", strings.Repeat("  ", e.Depth-1), markdownEscaper.Replace(statusMarks[e.Status]), name,
+			markdownEscaper.Replace(getLinkStr(e.node)), getFileSizeStr(e.node, opts), getHashStr(e.node), getHitsStr(e.node), getGitStr(e.node), markdownEscaper.Replace(getErrorStr(e.node)))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
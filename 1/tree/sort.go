@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+var sortKeys = map[string]func(a, b *node) int{
+	"name":  func(a, b *node) int { return 0 },
+	"size":  func(a, b *node) int { return compareInt64(b.Size, a.Size) },
+	"mtime": func(a, b *node) int { return compareInt64(b.ModTime.UnixNano(), a.ModTime.UnixNano()) },
+	"ext":   func(a, b *node) int { return compareString(path.Ext(a.Name), path.Ext(b.Name)) },
+}
+
+func checkSort(key string) error {
+	if _, ok := sortKeys[key]; key != "" && !ok {
+		return fmt.Errorf("unknown sort key %q", key)
+	}
+	return nil
+}
+
+// sortNodes orders the entries of one directory. Size and mtime put the
+// largest and the newest first, ties are always broken by name.
+func sortNodes(nodes []*node, opts options) {
+	if opts.Sort == "" && !opts.Reverse && !opts.DirsFirst {
+		return
+	}
+	cmp := sortKeys[opts.Sort]
+	if cmp == nil {
+		cmp = sortKeys["name"]
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if opts.DirsFirst && a.isDir() != b.isDir() {
+			return a.isDir()
+		}
+		c := cmp(a, b)
+		if c == 0 {
+			c = compareString(a.Name, b.Name)
+		}
+		if opts.Reverse {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareString(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
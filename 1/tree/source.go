@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// osFS is os.DirFS that also knows where it lives on disk, which is needed
+// for reading link targets and for telling directories apart by inode.
+type osFS struct {
+	fs.FS
+	root string
+}
+
+func newOSFS(root string) osFS {
+	return osFS{FS: os.DirFS(root), root: root}
+}
+
+func (f osFS) ReadLink(name string) (string, error) {
+	return os.Readlink(f.path(name))
+}
+
+func (f osFS) path(name string) string {
+	return filepath.Join(f.root, filepath.FromSlash(name))
+}
+
+// readLinkFS is implemented by the file systems that can report where a
+// symbolic link points to.
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+func readLink(fsys fs.FS, name string) (string, error) {
+	if lfs, ok := fsys.(readLinkFS); ok {
+		return lfs.ReadLink(name)
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+}
+
+// osPath returns the location of name on disk, or "" for trees that are
+// not backed by the os.
+func osPath(fsys fs.FS, name string) string {
+	if ofs, ok := fsys.(osFS); ok {
+		return ofs.path(name)
+	}
+	return ""
+}
+
+// openSource turns a command line argument into a file system: directories
+// are read from disk, zip and tar (optionally gzipped) archives are
+// recognized by their contents rather than the file extension. The files of
+// a gzipped tar can only be read when contents is set.
+func openSource(path string, contents bool) (fs.FS, io.Closer, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		return newOSFS(path), nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	magic := make([]byte, 512)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, nil, err
+	}
+	magic = magic[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		zr, err := zip.NewReader(f, fi.Size())
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return zr, f, nil
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gz.Close()
+		tfs, err := newTarFS(gz, contents)
+		return tfs, nil, err
+	case len(magic) > 262 && string(magic[257:262]) == "ustar":
+		tfs, err := newTarFS(f, contents)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return tfs, f, nil
+	}
+	f.Close()
+	return nil, nil, &fs.PathError{Op: "open", Path: path, Err: errors.New("not a directory or a supported archive")}
+}
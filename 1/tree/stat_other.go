@@ -0,0 +1,36 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+)
+
+// fileKey identifies a directory independently of the path it was reached by.
+// There is no inode to go by here, so the resolved path has to do, which
+// only works for trees that live on disk.
+type fileKey struct {
+	path string
+}
+
+func fileKeyOf(path string, fi fs.FileInfo) (fileKey, bool) {
+	if path == "" {
+		return fileKey{}, false
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		real = path
+	}
+	abs, err := filepath.Abs(real)
+	if err != nil {
+		abs = real
+	}
+	return fileKey{path: abs}, true
+}
+
+// fileOwner is not supported, the platform has no uid/gid to go by.
+func fileOwner(fi fs.FileInfo) (owner, group string, ok bool) {
+	return "", "", false
+}
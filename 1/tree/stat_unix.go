@@ -0,0 +1,61 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io/fs"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// fileKey identifies a directory independently of the path it was reached by.
+type fileKey struct {
+	dev, ino uint64
+}
+
+func fileKeyOf(path string, fi fs.FileInfo) (fileKey, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileKey{}, false
+	}
+	return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+var (
+	namesMu    sync.Mutex
+	userNames  = map[uint32]string{}
+	groupNames = map[uint32]string{}
+)
+
+// fileOwner resolves the owner and group of fi to names, falling back to
+// the numeric ids for accounts that do not exist on this machine.
+func fileOwner(fi fs.FileInfo) (owner, group string, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", "", false
+	}
+
+	namesMu.Lock()
+	defer namesMu.Unlock()
+
+	owner, ok = userNames[st.Uid]
+	if !ok {
+		owner = strconv.FormatUint(uint64(st.Uid), 10)
+		if u, err := user.LookupId(owner); err == nil {
+			owner = u.Username
+		}
+		userNames[st.Uid] = owner
+	}
+	group, ok = groupNames[st.Gid]
+	if !ok {
+		group = strconv.FormatUint(uint64(st.Gid), 10)
+		if g, err := user.LookupGroupId(group); err == nil {
+			group = g.Name
+		}
+		groupNames[st.Gid] = group
+	}
+	return owner, group, true
+}
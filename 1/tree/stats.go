@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const largestFiles = 10
+
+type extStats struct {
+	ext   string
+	files int
+	bytes int64
+}
+
+type treeStats struct {
+	dirs, files int
+	exts        []*extStats
+	largest     []fileRef
+}
+
+// collectStats counts the entries below root, the root itself excluded
+// like in the classic tree report.
+func collectStats(root *node) treeStats {
+	var st treeStats
+	byExt := map[string]*extStats{}
+	walkTree(root, func(e treeEntry) error {
+		if e.Type == typeMore {
+			return nil
+		}
+		if e.isDir() {
+			st.dirs++
+			return nil
+		}
+		st.files++
+		if e.Type != typeFile {
+			return nil
+		}
+		ext := path.Ext(e.Name)
+		if ext == "" || ext == e.Name {
+			ext = "(none)"
+		}
+		es := byExt[ext]
+		if es == nil {
+			es = &extStats{ext: ext}
+			byExt[ext] = es
+			st.exts = append(st.exts, es)
+		}
+		es.files++
+		es.bytes += e.Size
+		st.largest = append(st.largest, fileRef{n: e.node, path: e.Path})
+		return nil
+	})
+
+	sort.Slice(st.exts, func(i, j int) bool {
+		if st.exts[i].bytes != st.exts[j].bytes {
+			return st.exts[i].bytes > st.exts[j].bytes
+		}
+		return st.exts[i].ext < st.exts[j].ext
+	})
+	sort.SliceStable(st.largest, func(i, j int) bool {
+		return st.largest[i].n.Size > st.largest[j].n.Size
+	})
+	if len(st.largest) > largestFiles {
+		st.largest = st.largest[:largestFiles]
+	}
+	return st
+}
+
+func writeReport(out io.Writer, st treeStats, opts options) error {
+	if !opts.PrintFiles {
+		_, err := fmt.Fprintf(out, "\n%s\n", plural(st.dirs, "directory", "directories"))
+		return err
+	}
+	_, err := fmt.Fprintf(out, "\n%s, %s\n", plural(st.dirs, "directory", "directories"), plural(st.files, "file", "files"))
+	return err
+}
+
+// writeStats prints the per extension table, biggest consumers first, and
+// the largest single files.
+func writeStats(out io.Writer, st treeStats, opts options) error {
+	size := func(n int64) string {
+		if opts.Human {
+			return humanSize(n)
+		}
+		return fmt.Sprintf("%db", n)
+	}
+
+	extW, filesW, bytesW := len("extension"), len("files"), len("bytes")
+	for _, es := range st.exts {
+		extW = maxInt(extW, utf8.RuneCountInString(es.ext))
+		filesW = maxInt(filesW, len(strconv.Itoa(es.files)))
+		bytesW = maxInt(bytesW, len(size(es.bytes)))
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\n%-*s  %*s  %*s\n", extW, "extension", filesW, "files", bytesW, "bytes")
+	for _, es := range st.exts {
+		fmt.Fprintf(&sb, "%-*s  %*d  %*s\n", extW, es.ext, filesW, es.files, bytesW, size(es.bytes))
+	}
+
+	if len(st.largest) > 0 {
+		sizeW := 0
+		for _, f := range st.largest {
+			sizeW = maxInt(sizeW, len(size(f.n.Size)))
+		}
+		sb.WriteString("\nlargest files\n")
+		for _, f := range st.largest {
+			fmt.Fprintf(&sb, "%*s  %s\n", sizeW, size(f.n.Size), f.path)
+		}
+	}
+	_, err := io.WriteString(out, sb.String())
+	return err
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
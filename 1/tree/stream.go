@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// streamChunk is how many directory entries -U reads at a time.
+const streamChunk = 512
+
+// streamer prints the tree while it reads it, in directory order, for
+// directories too big to be held in memory and sorted. Each directory
+// keeps one entry back: only when the next one shows up, or the directory
+// ends, is it known whether the entry gets the └ branch.
+type streamer struct {
+	w          *walker
+	p          *textPrinter
+	dirs       int
+	files      int
+	lastLevels []bool
+}
+
+// streamEntry is an entry read from a directory, but not printed yet.
+type streamEntry struct {
+	n         *node
+	full, rel string
+	isDir     bool
+	chain     *dirChain
+}
+
+// streamConflicts are the options that need the whole tree in memory.
+func streamConflicts(opts options) error {
+	for _, c := range []struct {
+		name string
+		set  bool
+	}{
+		{"-o " + opts.Format, !opts.textOutput()},
+		{"--sort", opts.Sort != ""},
+		{"--reverse", opts.Reverse},
+		{"--dirs-first", opts.DirsFirst},
+		{"--du", opts.DirSizes},
+		{"--prune", opts.Prune},
+		{"--hash", opts.Hash != ""},
+		{"--dupes", opts.Dupes},
+		{"--stats", opts.Stats},
+		{"--grep", opts.Grep != ""},
+		{"--type and --only", opts.ShowType || len(opts.Only) > 0},
+		{"--git", opts.GitStatus},
+		{"--filelimit", opts.FileLimit > 0},
+		{"--skip-large", opts.SkipLarge > 0},
+		{"-p, -u, -g and -D", opts.Perms || opts.Owner || opts.Group || opts.Dates},
+	} {
+		if c.set {
+			return fmt.Errorf("-U cannot be combined with %s", c.name)
+		}
+	}
+	return nil
+}
+
+// streamTree is writeTreeFS for -U. Memory use only grows with the depth
+// of the tree, not with the size of its directories.
+func streamTree(out io.Writer, fsys fs.FS, opts options) (walkErr, err error) {
+	if err := streamConflicts(opts); err != nil {
+		return nil, err
+	}
+	if err := checkOptions(opts); err != nil {
+		return nil, err
+	}
+	fi, err := fs.Stat(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf(".: not a directory")
+	}
+	f, err := openDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &streamer{
+		w: &walker{fsys: fsys, opts: opts},
+		p: &textPrinter{out: out, opts: opts},
+	}
+	var chain *dirChain
+	if key, ok := fileKeyOf(osPath(fsys, "."), fi); ok {
+		chain = &dirChain{key: key}
+	}
+	if err := s.streamDir(f, ".", "", 1, nil, chain); err != nil {
+		return nil, err
+	}
+	if opts.Report {
+		if err := writeReport(out, treeStats{dirs: s.dirs, files: s.files}, opts); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.w.errs) > 0 {
+		return appendWalkErrors(nil, s.w.errs), nil
+	}
+	return nil, nil
+}
+
+func openDir(fsys fs.FS, name string) (fs.ReadDirFile, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := f.(fs.ReadDirFile)
+	if !ok {
+		f.Close()
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return d, nil
+}
+
+// streamDir prints the contents of the open directory f. Only write errors
+// are returned, read errors are marked on the entries like buildTree does.
+func (s *streamer) streamDir(f fs.ReadDirFile, dir, rel string, depth int, ignores []*ignoreFile, chain *dirChain) error {
+	if s.w.opts.GitIgnore {
+		ign, err := readIgnoreFile(s.w.fsys, path.Join(dir, ".gitignore"), rel)
+		if err != nil {
+			s.w.errs = append(s.w.errs, err)
+		}
+		if ign != nil {
+			ignores = append(ignores[:len(ignores):len(ignores)], ign)
+		}
+	}
+
+	var pending *streamEntry
+	for {
+		entries, err := f.ReadDir(streamChunk)
+		for _, entry := range entries {
+			e := s.accept(entry, dir, rel, ignores, chain)
+			if e == nil {
+				continue
+			}
+			if pending != nil {
+				if err := s.emit(pending, false, depth, ignores); err != nil {
+					return err
+				}
+			}
+			pending = e
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.w.errs = append(s.w.errs, err)
+			break
+		}
+		if len(entries) == 0 {
+			break
+		}
+	}
+	if pending != nil {
+		return s.emit(pending, true, depth, ignores)
+	}
+	return nil
+}
+
+// accept turns a directory entry into the node to print, or nil when the
+// options leave it out.
+func (s *streamer) accept(entry fs.DirEntry, dir, rel string, ignores []*ignoreFile, chain *dirChain) *streamEntry {
+	opts := s.w.opts
+	if !opts.All && strings.HasPrefix(entry.Name(), ".") {
+		return nil
+	}
+	e := &streamEntry{
+		n:     &node{Name: entry.Name(), Type: typeFile, mode: entry.Type()},
+		full:  path.Join(dir, entry.Name()),
+		rel:   path.Join(rel, entry.Name()),
+		isDir: entry.IsDir(),
+		chain: chain,
+	}
+
+	var fi fs.FileInfo
+	if entry.Type()&fs.ModeSymlink != 0 {
+		e.n.Type = typeLink
+		if target, err := readLink(s.w.fsys, e.full); err != nil {
+			s.w.fail(e.n, err)
+		} else {
+			e.n.Link = target
+		}
+		if opts.FollowLinks {
+			if target, err := fs.Stat(s.w.fsys, e.full); err == nil {
+				fi = target
+				e.isDir = target.IsDir()
+			} else {
+				e.n.orphan = true
+			}
+		}
+	}
+	if matchAny(opts.Exclude, e.rel) || ignored(ignores, e.rel, e.isDir) {
+		return nil
+	}
+
+	if e.isDir {
+		e.n.Type = typeDir
+		if opts.FollowLinks && fi == nil {
+			fi, _ = entry.Info()
+		}
+		if fi != nil {
+			e.n.mode = fi.Mode()
+			if key, ok := fileKeyOf(osPath(s.w.fsys, e.full), fi); ok {
+				if chain.contains(key) {
+					e.n.Cycle = true
+				} else {
+					e.chain = &dirChain{key: key, parent: chain}
+				}
+			}
+		}
+		return e
+	}
+	if !opts.PrintFiles || len(opts.Include) > 0 && !matchAny(opts.Include, e.rel) {
+		return nil
+	}
+	if fi == nil {
+		var err error
+		if fi, err = entry.Info(); err != nil {
+			s.w.fail(e.n, err)
+			return e
+		}
+	}
+	e.n.Size = fi.Size()
+	e.n.mode = fi.Mode()
+	return e
+}
+
+// emit prints e and, for directories within the depth limit, everything
+// below it. The directory is opened first so an error ends up on its line.
+func (s *streamer) emit(e *streamEntry, last bool, depth int, ignores []*ignoreFile) error {
+	var sub fs.ReadDirFile
+	if e.isDir && !e.n.Cycle && (s.w.opts.MaxDepth == 0 || depth < s.w.opts.MaxDepth) {
+		f, err := openDir(s.w.fsys, e.full)
+		if err != nil {
+			s.w.fail(e.n, err)
+		} else {
+			sub = f
+			defer f.Close()
+		}
+	}
+
+	if e.n.isDir() {
+		s.dirs++
+	} else {
+		s.files++
+	}
+	te := treeEntry{node: e.n, Depth: depth, Last: last, lastAncestors: s.lastLevels}
+	if err := s.p.line(te); err != nil {
+		return err
+	}
+	if sub == nil {
+		return nil
+	}
+	s.lastLevels = append(s.lastLevels, last)
+	defer func() { s.lastLevels = s.lastLevels[:len(s.lastLevels)-1] }()
+	return s.streamDir(sub, e.full, e.rel, depth+1, ignores, e.chain)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tarFS is an fs.FS over the contents of a tar stream. Tar has no index to
+// seek by, so the headers are all read up front. File contents are read
+// from the archive when it is a file on disk, and otherwise kept in memory
+// only when they are asked for.
+type tarFS struct {
+	entries map[string]*tarEntry
+
+	// archive is set when the contents can be read in place
+	archive io.ReaderAt
+}
+
+type tarEntry struct {
+	hdr      *tar.Header
+	data     []byte
+	children []fs.DirEntry
+
+	// offset of the contents in tarFS.archive, -1 when they are in data or
+	// were not loaded
+	offset int64
+}
+
+// tarArchive is a tar stream that can be read at any position.
+type tarArchive interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// tarCounter tells how far tar.Reader got into the archive, which right
+// after Next is where the contents of the entry start.
+type tarCounter struct {
+	r   io.ReadSeeker
+	pos int64
+}
+
+func (c *tarCounter) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *tarCounter) Seek(offset int64, whence int) (int64, error) {
+	pos, err := c.r.Seek(offset, whence)
+	if err == nil {
+		c.pos = pos
+	}
+	return pos, err
+}
+
+// newTarFS reads the tar stream r, which must be at its start. When r is a
+// tarArchive the contents of files stay in it and r has to be kept open
+// while the tarFS is used. Otherwise they are read into memory if contents
+// is set, and cannot be read at all if not.
+func newTarFS(r io.Reader, contents bool) (*tarFS, error) {
+	tfs := &tarFS{entries: map[string]*tarEntry{
+		".": {hdr: &tar.Header{Name: ".", Typeflag: tar.TypeDir, Mode: 0o755}, offset: -1},
+	}}
+	var counter *tarCounter
+	if ar, ok := r.(tarArchive); ok {
+		counter = &tarCounter{r: ar}
+		tfs.archive = ar
+		r = counter
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if name == "." || !fs.ValidPath(name) {
+			continue
+		}
+		e := &tarEntry{hdr: hdr, offset: -1}
+		if hdr.Typeflag == tar.TypeReg {
+			switch {
+			case counter != nil && !sparse(hdr):
+				e.offset = counter.pos
+			case contents:
+				if e.data, err = io.ReadAll(tr); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if old, ok := tfs.entries[name]; ok {
+			// a directory may show up after its contents
+			e.children = old.children
+		} else {
+			tfs.addToParent(name, e)
+		}
+		tfs.entries[name] = e
+	}
+
+	for _, e := range tfs.entries {
+		sort.Slice(e.children, func(i, j int) bool {
+			return e.children[i].Name() < e.children[j].Name()
+		})
+	}
+	return tfs, nil
+}
+
+// sparse reports whether the contents of the entry are stored in pieces,
+// which only tar.Reader knows how to put back together.
+func sparse(hdr *tar.Header) bool {
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// addToParent links e into its directory, making up directories that the
+// archive lists only implicitly.
+func (tfs *tarFS) addToParent(name string, e *tarEntry) {
+	dir := path.Dir(name)
+	parent, ok := tfs.entries[dir]
+	if !ok {
+		parent = &tarEntry{hdr: &tar.Header{
+			Name:     dir,
+			Typeflag: tar.TypeDir,
+			Mode:     0o755,
+			ModTime:  time.Unix(0, 0),
+		}, offset: -1}
+		tfs.addToParent(dir, parent)
+		tfs.entries[dir] = parent
+	}
+	parent.children = append(parent.children, tarDirEntry{tfs: tfs, name: name})
+}
+
+func (tfs *tarFS) lookup(op, name string) (*tarEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := tfs.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (tfs *tarFS) Open(name string) (fs.File, error) {
+	e, err := tfs.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f := &tarFile{entry: e, name: name}
+	switch {
+	case e.hdr.Typeflag == tar.TypeDir:
+	case e.offset >= 0:
+		f.r = io.NewSectionReader(tfs.archive, e.offset, e.hdr.Size)
+	case e.data != nil || e.hdr.Typeflag != tar.TypeReg || e.hdr.Size == 0:
+		f.r = bytes.NewReader(e.data)
+	default:
+		f.err = errNotLoaded
+	}
+	return f, nil
+}
+
+func (tfs *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := tfs.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.hdr.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return append([]fs.DirEntry(nil), e.children...), nil
+}
+
+func (tfs *tarFS) ReadLink(name string) (string, error) {
+	e, err := tfs.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if e.hdr.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return e.hdr.Linkname, nil
+}
+
+// errNotLoaded is what reading a file of a compressed tar gives when the
+// contents were not asked for.
+var errNotLoaded = errors.New("contents of the archive were not loaded")
+
+type tarFile struct {
+	entry  *tarEntry
+	name   string
+	r      io.Reader
+	err    error
+	offset int
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) {
+	return tarFileInfo{f.entry.hdr, f.name}, nil
+}
+
+func (f *tarFile) Read(b []byte) (int, error) {
+	if f.err != nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: f.err}
+	}
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	return f.r.Read(b)
+}
+
+func (f *tarFile) Close() error {
+	return nil
+}
+
+func (f *tarFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.entry.hdr.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrInvalid}
+	}
+	rest := f.entry.children[f.offset:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	f.offset += len(rest)
+	return append([]fs.DirEntry(nil), rest...), nil
+}
+
+// tarFileInfo reports the base name of the entry, tar.Header.FileInfo would
+// return the full path for the made up root.
+type tarFileInfo struct {
+	hdr  *tar.Header
+	name string
+}
+
+func (fi tarFileInfo) Name() string {
+	return path.Base(fi.name)
+}
+
+func (fi tarFileInfo) Size() int64 {
+	return fi.hdr.Size
+}
+
+func (fi tarFileInfo) Mode() fs.FileMode {
+	return fi.hdr.FileInfo().Mode()
+}
+
+func (fi tarFileInfo) ModTime() time.Time {
+	return fi.hdr.ModTime
+}
+
+func (fi tarFileInfo) IsDir() bool {
+	return fi.hdr.Typeflag == tar.TypeDir
+}
+
+func (fi tarFileInfo) Sys() interface{} {
+	return fi.hdr
+}
+
+type tarDirEntry struct {
+	tfs  *tarFS
+	name string
+}
+
+func (d tarDirEntry) info() tarFileInfo {
+	return tarFileInfo{d.tfs.entries[d.name].hdr, d.name}
+}
+
+func (d tarDirEntry) Name() string {
+	return path.Base(d.name)
+}
+
+func (d tarDirEntry) IsDir() bool {
+	return d.info().IsDir()
+}
+
+func (d tarDirEntry) Type() fs.FileMode {
+	return d.info().Mode().Type()
+}
+
+func (d tarDirEntry) Info() (fs.FileInfo, error) {
+	return d.info(), nil
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	typeDir  = "directory"
+	typeFile = "file"
+	typeLink = "link"
+	typeMore = "more"
+)
+
+// node is one entry of the in-memory tree that renderers work on.
+type node struct {
+	XMLName  xml.Name  `json:"-" xml:"node"`
+	Name     string    `json:"name" xml:"name,attr"`
+	Type     string    `json:"type" xml:"type,attr"`
+	Size     int64     `json:"size" xml:"size,attr"`
+	Link     string    `json:"target,omitempty" xml:"target,attr,omitempty"`
+	Cycle    bool      `json:"cycle,omitempty" xml:"cycle,attr,omitempty"`
+	Error    string    `json:"error,omitempty" xml:"error,attr,omitempty"`
+	Hash     string    `json:"hash,omitempty" xml:"hash,attr,omitempty"`
+	Hits     int       `json:"hits,omitempty" xml:"hits,attr,omitempty"`
+	MIME     string    `json:"mime,omitempty" xml:"mime,attr,omitempty"`
+	Git      string    `json:"git,omitempty" xml:"git,attr,omitempty"`
+	More     int       `json:"more,omitempty" xml:"more,attr,omitempty"`
+	Unopened int       `json:"unopened,omitempty" xml:"unopened,attr,omitempty"`
+	Status   string    `json:"status,omitempty" xml:"status,attr,omitempty"`
+	Mode     string    `json:"mode,omitempty" xml:"mode,attr,omitempty"`
+	Owner    string    `json:"owner,omitempty" xml:"owner,attr,omitempty"`
+	Group    string    `json:"group,omitempty" xml:"group,attr,omitempty"`
+	MTime    string    `json:"mtime,omitempty" xml:"mtime,attr,omitempty"`
+	ModTime  time.Time `json:"-" xml:"-"`
+	Children []*node   `json:"children,omitempty" xml:"node"`
+
+	mode   fs.FileMode
+	orphan bool
+}
+
+func (n *node) isDir() bool {
+	return n.Type == typeDir
+}
+
+// limitEntries keeps the first limit entries of every directory and counts
+// the rest in More.
+func limitEntries(parent *node, limit int) {
+	if len(parent.Children) > limit {
+		parent.More = len(parent.Children) - limit
+		parent.Children = parent.Children[:limit]
+	}
+	for _, n := range parent.Children {
+		limitEntries(n, limit)
+	}
+}
+
+// dropFiles removes everything but directories from the tree.
+func dropFiles(parent *node) {
+	dirs := parent.Children[:0]
+	for _, n := range parent.Children {
+		if n.isDir() {
+			dropFiles(n)
+			dirs = append(dirs, n)
+		}
+	}
+	parent.Children = dirs
+}
+
+// keepFiles leaves only the files keep accepts and the directories on the
+// way to them. Entries with errors stay, so what could not be looked at is
+// still visible.
+func keepFiles(parent *node, keep func(n *node) bool) bool {
+	kept := parent.Children[:0]
+	for _, n := range parent.Children {
+		if n.isDir() {
+			if !keepFiles(n, keep) && n.Error == "" {
+				continue
+			}
+		} else if !keep(n) && n.Error == "" {
+			continue
+		}
+		kept = append(kept, n)
+	}
+	parent.Children = kept
+	return len(kept) > 0
+}
+
+var errTooLarge = errors.New("too many entries")
+
+// readDirLimit is fs.ReadDir that gives up with errTooLarge as soon as it
+// has seen more than limit entries, so --skip-large never reads all of a
+// huge directory. A limit of 0 reads everything.
+func readDirLimit(fsys fs.FS, name string, limit int) ([]fs.DirEntry, error) {
+	if limit <= 0 {
+		return fs.ReadDir(fsys, name)
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.ErrUnsupported}
+	}
+
+	entries, err := d.ReadDir(limit + 1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(entries) > limit {
+		return nil, errTooLarge
+	}
+	if err == nil {
+		// the first call may return less than asked for without being done
+		rest, err := d.ReadDir(-1)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries)+len(rest) > limit {
+			return nil, errTooLarge
+		}
+		entries = append(entries, rest...)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+type walker struct {
+	fsys fs.FS
+	opts options
+	sem  chan struct{}
+
+	// later, when set, makes fillDir read only one level: the reads of the
+	// subdirectories are stored here instead of run, for walkFS to do once
+	// it gets to them.
+	later map[*node]func()
+
+	mu   sync.Mutex
+	errs []error
+}
+
+// child is an entry of the directory being read, found is only known once
+// the walk of its subtree has finished.
+type child struct {
+	n     *node
+	found bool
+}
+
+// spawn runs f on its own goroutine while there are free slots and inline
+// otherwise, so the number of goroutines stays bounded by -j. Results are
+// stored by position and not by completion, which keeps the output in the
+// same order as the sequential walk.
+func (w *walker) spawn(wg *sync.WaitGroup, f func()) {
+	select {
+	case w.sem <- struct{}{}:
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-w.sem
+				wg.Done()
+			}()
+			f()
+		}()
+	default:
+		f()
+	}
+}
+
+// dirChain is the list of directories from the root down to the one being
+// read, used to spot symlinks that lead back into their own ancestors.
+type dirChain struct {
+	key    fileKey
+	parent *dirChain
+}
+
+func (c *dirChain) contains(key fileKey) bool {
+	for ; c != nil; c = c.parent {
+		if c.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// walkErrors collects everything that went wrong below the root. The walk
+// itself keeps going and the failures are shown inline, --strict turns them
+// into the result of dirTree.
+type walkErrors []error
+
+func (e walkErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e walkErrors) Unwrap() []error {
+	return e
+}
+
+// appendWalkErrors adds errs to the walkErrors in err, which may be nil.
+func appendWalkErrors(err error, errs []error) error {
+	if len(errs) == 0 {
+		return err
+	}
+	all, _ := err.(walkErrors)
+	all = append(all[:len(all):len(all)], errs...)
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Error() < all[j].Error()
+	})
+	return all
+}
+
+// buildTree returns the model of the root directory of fsys. A root that
+// cannot be read is an error on its own, failures further down are returned
+// as walkErrors alongside a usable tree.
+func buildTree(fsys fs.FS, root string, opts options) (*node, error) {
+	w, n, chain, err := openTree(fsys, root, opts)
+	if err != nil {
+		return nil, err
+	}
+	w.fillDir(n, root, "", 1, nil, chain)
+	return n, w.err()
+}
+
+// openTree checks that root is a directory that can be read and returns the
+// walker and the node for it, with nothing below it read yet.
+func openTree(fsys fs.FS, root string, opts options) (*walker, *node, *dirChain, error) {
+	fi, err := fs.Stat(fsys, root)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !fi.IsDir() {
+		return nil, nil, nil, fmt.Errorf("%s: not a directory", root)
+	}
+	f, err := fsys.Open(root)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f.Close()
+
+	w := &walker{fsys: fsys, opts: opts}
+	if opts.Jobs > 1 {
+		w.sem = make(chan struct{}, opts.Jobs-1)
+	}
+	n := &node{Name: path.Base(root), Type: typeDir}
+	w.setInfo(n, fi)
+	var chain *dirChain
+	if key, ok := fileKeyOf(osPath(fsys, root), fi); ok {
+		chain = &dirChain{key: key}
+	}
+	return w, n, chain, nil
+}
+
+// err returns the failures of the walk so far as walkErrors, or nil.
+func (w *walker) err() error {
+	if len(w.errs) == 0 {
+		return nil
+	}
+	sort.Slice(w.errs, func(i, j int) bool {
+		return w.errs[i].Error() < w.errs[j].Error()
+	})
+	return walkErrors(w.errs)
+}
+
+const timeFormat = "2006-01-02 15:04"
+
+// setInfo copies the metadata the options ask for from fi into n.
+func (w *walker) setInfo(n *node, fi fs.FileInfo) {
+	n.ModTime = fi.ModTime()
+	n.mode = fi.Mode()
+	if w.opts.Perms {
+		n.Mode = fi.Mode().String()
+	}
+	if w.opts.Owner || w.opts.Group {
+		if owner, group, ok := ownerOf(fi); ok {
+			if w.opts.Owner {
+				n.Owner = owner
+			}
+			if w.opts.Group {
+				n.Group = group
+			}
+		}
+	}
+	if w.opts.Dates {
+		n.MTime = fi.ModTime().Format(timeFormat)
+	}
+}
+
+// ownerOf returns the user and group names of a file, tar archives carry
+// them in the header.
+func ownerOf(fi fs.FileInfo) (owner, group string, ok bool) {
+	if hdr, isTar := fi.Sys().(*tar.Header); isTar {
+		owner, group = hdr.Uname, hdr.Gname
+		if owner == "" {
+			owner = strconv.Itoa(hdr.Uid)
+		}
+		if group == "" {
+			group = strconv.Itoa(hdr.Gid)
+		}
+		return owner, group, true
+	}
+	return fileOwner(fi)
+}
+
+func (w *walker) fail(n *node, err error) {
+	w.mu.Lock()
+	w.errs = append(w.errs, err)
+	w.mu.Unlock()
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		n.Error = pe.Err.Error()
+	} else {
+		n.Error = err.Error()
+	}
+}
+
+// fillDir reads dir into parent and reports whether the subtree holds any
+// files, which is what --prune decides on. Unreadable directories are kept
+// so their error stays visible. Directories past the depth limit are not read
+// at all and count as non-empty, since we never looked inside, unless --du
+// needs their sizes: then they are walked but left out of the model.
+func (w *walker) fillDir(parent *node, dir, rel string, depth int, ignores []*ignoreFile, ancestors *dirChain) bool {
+	if w.opts.MaxDepth > 0 && depth > w.opts.MaxDepth {
+		if !w.opts.DirSizes {
+			return true
+		}
+		defer func() { parent.Children = nil }()
+	}
+
+	if w.opts.GitIgnore {
+		ign, err := readIgnoreFile(w.fsys, path.Join(dir, ".gitignore"), rel)
+		if err != nil {
+			w.fail(parent, err)
+		}
+		if ign != nil {
+			ignores = append(ignores[:len(ignores):len(ignores)], ign)
+		}
+	}
+
+	limit := 0
+	if depth > 1 {
+		limit = w.opts.SkipLarge
+	}
+	entries, err := readDirLimit(w.fsys, dir, limit)
+	if err == errTooLarge {
+		parent.Unopened = limit
+		return true
+	}
+	if err != nil {
+		w.fail(parent, err)
+		return true
+	}
+	hasFiles := false
+
+	var wg sync.WaitGroup
+	children := make([]*child, 0, len(entries))
+
+	for _, entry := range entries {
+		if !w.opts.All && strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		full := path.Join(dir, entry.Name())
+		entryRel := path.Join(rel, entry.Name())
+		n := &node{Name: entry.Name(), Type: typeFile}
+		isDir := entry.IsDir()
+
+		var fi fs.FileInfo
+		if entry.Type()&fs.ModeSymlink != 0 {
+			n.Type = typeLink
+			if target, err := readLink(w.fsys, full); err != nil {
+				w.fail(n, err)
+			} else {
+				n.Link = target
+			}
+			// a dangling link is still listed, just not followed
+			if w.opts.FollowLinks {
+				if target, err := fs.Stat(w.fsys, full); err == nil {
+					fi = target
+					isDir = target.IsDir()
+				} else {
+					n.orphan = true
+				}
+			}
+		}
+
+		if matchAny(w.opts.Exclude, entryRel) || ignored(ignores, entryRel, isDir) {
+			continue
+		}
+
+		c := &child{n: n, found: true}
+		if isDir {
+			n.Type = typeDir
+			chain := ancestors
+			if (w.opts.FollowLinks || w.opts.needsInfo()) && fi == nil {
+				fi, _ = entry.Info()
+			}
+			if fi != nil {
+				w.setInfo(n, fi)
+				if key, ok := fileKeyOf(osPath(w.fsys, full), fi); ok {
+					if ancestors.contains(key) {
+						n.Cycle = true
+						children = append(children, c)
+						continue
+					}
+					chain = &dirChain{key: key, parent: ancestors}
+				}
+			}
+			if w.later != nil {
+				w.later[n] = func() { w.fillDir(n, full, entryRel, depth+1, ignores, chain) }
+			} else {
+				w.spawn(&wg, func() {
+					c.found = w.fillDir(n, full, entryRel, depth+1, ignores, chain)
+				})
+			}
+		} else {
+			if len(w.opts.Include) > 0 && !matchAny(w.opts.Include, entryRel) {
+				continue
+			}
+			if w.opts.PrintFiles || w.opts.DirSizes || w.opts.needsInfo() {
+				var err error
+				if fi == nil {
+					fi, err = entry.Info()
+				}
+				if err != nil {
+					w.fail(n, err)
+				} else {
+					n.Size = fi.Size()
+					w.setInfo(n, fi)
+				}
+			}
+		}
+		children = append(children, c)
+	}
+	wg.Wait()
+
+	for _, c := range children {
+		if c.n.isDir() && !c.found && w.opts.Prune {
+			continue
+		}
+		hasFiles = hasFiles || c.found
+		if w.opts.DirSizes {
+			parent.Size += c.n.Size
+		}
+		if c.n.isDir() || w.opts.PrintFiles {
+			parent.Children = append(parent.Children, c.n)
+		}
+	}
+	sortNodes(parent.Children, w.opts)
+	return hasFiles
+}
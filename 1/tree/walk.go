@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// treeEntry is one node as seen from the walk: where it sits in the tree
+// and how it relates to its siblings, which is all the text renderer needs
+// to draw the graphics.
+type treeEntry struct {
+	*node
+	Path  string
+	Depth int
+	Last  bool
+
+	// lastAncestors tells for every level above the entry whether the
+	// ancestor there was the last of its siblings. The slice is reused
+	// between calls and must not be kept.
+	lastAncestors []bool
+}
+
+// prefix is the indentation drawn in front of the entry's branch.
+func (e treeEntry) prefix() string {
+	var sb strings.Builder
+	for _, last := range e.lastAncestors {
+		if last {
+			sb.WriteString("\t")
+		} else {
+			sb.WriteString("│\t")
+		}
+	}
+	return sb.String()
+}
+
+// walkFunc is called for every entry below the root in display order.
+// Directories cut short by --filelimit end with an entry of typeMore that
+// stands for the entries left out.
+// Returning fs.SkipDir from a directory skips its contents, from a file it
+// skips the remaining siblings. fs.SkipAll ends the walk without an error,
+// anything else ends it and is returned by walkTree.
+type walkFunc func(e treeEntry) error
+
+func walkTree(root *node, fn walkFunc) error {
+	err := walkChildren(root, "", 1, nil, fn)
+	if err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkChildren(parent *node, dir string, depth int, lastAncestors []bool, fn walkFunc) error {
+	for i, n := range parent.Children {
+		e := treeEntry{
+			node:          n,
+			Path:          path.Join(dir, n.Name),
+			Depth:         depth,
+			Last:          i == len(parent.Children)-1 && parent.More == 0,
+			lastAncestors: lastAncestors,
+		}
+		if err := fn(e); err != nil {
+			if err == fs.SkipDir {
+				if n.isDir() {
+					continue
+				}
+				return nil
+			}
+			return err
+		}
+		if err := walkChildren(n, e.Path, depth+1, append(lastAncestors, e.Last), fn); err != nil {
+			return err
+		}
+	}
+	if parent.More > 0 {
+		more := &node{Name: "… " + plural(parent.More, "more entry", "more entries"), Type: typeMore}
+		if err := fn(treeEntry{node: more, Path: dir, Depth: depth, Last: true, lastAncestors: lastAncestors}); err != nil && err != fs.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkConflicts are the options that work on the finished tree in
+// writeTreeFS and that walkFS has no way to apply.
+func walkConflicts(opts options) error {
+	for _, c := range []struct {
+		name string
+		set  bool
+	}{
+		{"--hash", opts.Hash != ""},
+		{"--dupes", opts.Dupes},
+		{"--grep", opts.Grep != "" || opts.GrepCount},
+		{"--type and --only", opts.ShowType || len(opts.Only) > 0},
+		{"--git", opts.GitStatus},
+	} {
+		if c.set {
+			return fmt.Errorf("walkFS does not apply %s", c.name)
+		}
+	}
+	return nil
+}
+
+// walkFS walks the tree of fsys with opts. Directories are read when the
+// walk gets to them, so the parts skipped with fs.SkipDir and fs.SkipAll are
+// never read. Only --prune and --du, which need a whole subtree before they
+// can tell about its root, read everything first. Failures to read parts of
+// the tree are returned after the walk as walkErrors. The options that read
+// file contents are rejected, see walkConflicts, and the ones about output
+// such as -o, colors, --stats and the report have no effect.
+func walkFS(fsys fs.FS, opts options, fn walkFunc) error {
+	if err := walkConflicts(opts); err != nil {
+		return err
+	}
+	if err := checkOptions(opts); err != nil {
+		return err
+	}
+	if opts.Prune || opts.DirSizes {
+		root, walkErr := buildTree(fsys, ".", opts)
+		if root == nil {
+			return walkErr
+		}
+		if opts.FileLimit > 0 {
+			limitEntries(root, opts.FileLimit)
+		}
+		if err := walkTree(root, fn); err != nil {
+			return err
+		}
+		return walkErr
+	}
+
+	w, root, chain, err := openTree(fsys, ".", opts)
+	if err != nil {
+		return err
+	}
+	w.later = map[*node]func(){}
+	w.fillDir(root, ".", "", 1, nil, chain)
+	if opts.FileLimit > 0 {
+		limitEntries(root, opts.FileLimit)
+	}
+	err = walkTree(root, func(e treeEntry) error {
+		if err := fn(e); err != nil {
+			return err
+		}
+		if read, ok := w.later[e.node]; ok {
+			delete(w.later, e.node)
+			read()
+			if opts.FileLimit > 0 {
+				limitEntries(e.node, opts.FileLimit)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return w.err()
+}
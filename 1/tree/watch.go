@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+const clearScreen = "\x1b[H\x1b[2J"
+
+// watchTree redraws the tree of path whenever something below it changes,
+// until stop is closed. Changes are found by polling: every interval the
+// tree is read again and compared with the previous snapshot by size and
+// mtime, so no platform specific notification API is needed. Entries added
+// or removed since the last redraw are marked the same way as in --diff.
+func watchTree(out io.Writer, path string, opts options, interval time.Duration, stop <-chan struct{}) error {
+	render, err := lookupRenderer(opts.Format)
+	if err != nil {
+		return err
+	}
+	if err := checkOptions(opts); err != nil {
+		return err
+	}
+	fsys, closer, err := openSource(path, opts.readsFiles())
+	if err != nil {
+		return err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	buildOpts := opts
+	buildOpts.PrintFiles = true
+	snapshot := func() (*node, error) {
+		root, err := buildTree(fsys, ".", buildOpts)
+		if root == nil {
+			return nil, err
+		}
+		root.Name = filepath.Base(path)
+		return root, nil
+	}
+
+	prev, err := snapshot()
+	if err != nil {
+		return err
+	}
+	shown, stats := prev, diffStats{}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if shown != nil {
+			if err := drawWatch(out, path, interval, shown, stats, render, opts); err != nil {
+				return err
+			}
+			shown = nil
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		cur, err := snapshot()
+		if err != nil {
+			return err
+		}
+		d := &differ{opts: opts, mtimes: true}
+		children := d.merge(".", prev.Children, cur.Children)
+		prev = cur
+		if d.stats != (diffStats{}) {
+			shown = &node{Name: cur.Name, Type: typeDir, Children: children}
+			stats = d.stats
+		}
+	}
+}
+
+func drawWatch(out io.Writer, path string, interval time.Duration, root *node, stats diffStats, render renderer, opts options) error {
+	if !opts.PrintFiles {
+		dropFiles(root)
+	}
+	if opts.textOutput() {
+		if _, err := fmt.Fprintf(out, "%sEvery %s: tree %s\t%s\n\n", clearScreen, interval, path, time.Now().Format(timeFormat+":05")); err != nil {
+			return err
+		}
+	}
+	if err := render(out, root, opts); err != nil {
+		return err
+	}
+	if opts.textOutput() && stats != (diffStats{}) {
+		_, err := fmt.Fprintf(out, "\n%s\n", stats)
+		return err
+	}
+	return nil
+}